@@ -3,15 +3,20 @@ package crypto
 // hash.go supplies a few geneeral hashing functions, using the hashing
 // algorithm blake2b. Because changing the hashing algorithm for Sia has much
 // stronger implications than changing any of the other algorithms, blake2b is
-// the only supported algorithm. Sia is not really flexible enough to support
-// multiple.
+// the consensus algorithm, and Sia is not really flexible enough to support
+// multiple. The alternative hashers accepted by NewTreeHasher, ProofParams and
+// RegisterAlgorithm exist only for interoperating with external tools and
+// verifying their proofs.
 
 import (
 	"bytes"
+	"encoding/base32"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"hash"
+	"sort"
+	"strings"
 
 	"github.com/NebulousLabs/Sia/encoding"
 
@@ -20,6 +25,11 @@ import (
 
 const (
 	HashSize = 32
+
+	// base32ChecksumSize is the number of checksum bytes appended to a hash
+	// before it is base32-encoded. A hash and its checksum are 35 bytes, which
+	// encodes to exactly 56 characters without padding.
+	base32ChecksumSize = 3
 )
 
 type (
@@ -31,6 +41,10 @@ type (
 
 var (
 	ErrHashWrongLen = errors.New("encoded value has the wrong length to be a hash")
+
+	// ErrBadChecksum is returned when a base32-encoded hash does not match
+	// its checksum.
+	ErrBadChecksum = errors.New("base32 hash has an invalid checksum")
 )
 
 // NewHash returns a blake2b 256bit hasher.
@@ -65,11 +79,52 @@ func HashObject(obj interface{}) (hash Hash) {
 	return
 }
 
+// CombineUnordered returns a commitment to a set of hashes that does not
+// depend on their order. The hashes are sorted by byte value and the sorted
+// slice is hashed. Unlike a Merkle root, the commitment cannot be used to prove
+// membership of a single hash without revealing the whole set.
+func CombineUnordered(roots []Hash) Hash {
+	sorted := append(HashSlice(nil), roots...)
+	sort.Sort(sorted)
+	return HashObject(sorted)
+}
+
 // These functions implement sort.Interface, allowing hashes to be sorted.
 func (hs HashSlice) Len() int           { return len(hs) }
 func (hs HashSlice) Less(i, j int) bool { return bytes.Compare(hs[i][:], hs[j][:]) < 0 }
 func (hs HashSlice) Swap(i, j int)      { hs[i], hs[j] = hs[j], hs[i] }
 
+// base32Checksum returns the checksum appended to a hash before it is
+// base32-encoded.
+func base32Checksum(h Hash) []byte {
+	sum := HashBytes(h[:])
+	return sum[:base32ChecksumSize]
+}
+
+// Base32 returns the hash, followed by a short checksum, in lowercase base32.
+// It is more compact than hex and suitable for URLs, and typos are detected by
+// ParseHashBase32.
+func (h Hash) Base32() string {
+	b := append(append([]byte(nil), h[:]...), base32Checksum(h)...)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
+
+// ParseHashBase32 parses a hash encoded by Base32. Parsing is not case
+// sensitive. ErrBadChecksum is returned if the checksum does not match.
+func ParseHashBase32(s string) (h Hash, err error) {
+	b, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil {
+		return Hash{}, errors.New("could not decode base32 hash: " + err.Error())
+	} else if len(b) != HashSize+base32ChecksumSize {
+		return Hash{}, ErrHashWrongLen
+	}
+	copy(h[:], b)
+	if !bytes.Equal(b[HashSize:], base32Checksum(h)) {
+		return Hash{}, ErrBadChecksum
+	}
+	return h, nil
+}
+
 // LoadString takes a string, parses the hash value of the string, and sets the
 // value of the hash equal to the hash value of the string.
 func (h *Hash) LoadString(s string) error {
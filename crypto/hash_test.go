@@ -195,3 +195,67 @@ func TestHashLoadString(t *testing.T) {
 		t.Fatal("expecting error when decoding hash of too small length")
 	}
 }
+
+// TestHashBase32 checks that hashes can be round-tripped through base32, and
+// that corrupted strings are rejected.
+func TestHashBase32(t *testing.T) {
+	h := HashObject("an object")
+	s := h.Base32()
+	if len(s) != 56 {
+		t.Fatal("wrong base32 length:", len(s))
+	}
+	for _, str := range []string{s, strings.ToUpper(s)} {
+		parsed, err := ParseHashBase32(str)
+		if err != nil {
+			t.Fatal(err)
+		} else if parsed != h {
+			t.Fatal("base32 round trip produced the wrong hash")
+		}
+	}
+
+	// Change a single character.
+	bad := []byte(s)
+	if bad[10] == 'a' {
+		bad[10] = 'b'
+	} else {
+		bad[10] = 'a'
+	}
+	if _, err := ParseHashBase32(string(bad)); err != ErrBadChecksum {
+		t.Error("expected ErrBadChecksum, got", err)
+	}
+	if _, err := ParseHashBase32(s[:48]); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+	if _, err := ParseHashBase32(s[:55] + "1"); err == nil {
+		t.Error("expected an error for invalid base32")
+	}
+}
+
+// TestCombineUnordered checks that CombineUnordered does not depend on the
+// order of its input, and does not modify it.
+func TestCombineUnordered(t *testing.T) {
+	roots := make([]Hash, 10)
+	for i := range roots {
+		fastrand.Read(roots[i][:])
+	}
+	first := roots[0]
+	c := CombineUnordered(roots)
+	if roots[0] != first {
+		t.Fatal("CombineUnordered modified its input")
+	}
+	for i := 0; i < 5; i++ {
+		shuffled := make([]Hash, len(roots))
+		for j, k := range fastrand.Perm(len(roots)) {
+			shuffled[j] = roots[k]
+		}
+		if CombineUnordered(shuffled) != c {
+			t.Fatal("CombineUnordered depends on the order of the roots")
+		}
+	}
+	if CombineUnordered(roots[1:]) == c {
+		t.Error("CombineUnordered ignored a root")
+	}
+	if CombineUnordered(nil) != CombineUnordered([]Hash{}) {
+		t.Error("nil and empty sets have different commitments")
+	}
+}
@@ -1,11 +1,24 @@
 package crypto
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
 
 	"github.com/NebulousLabs/Sia/encoding"
 
 	"github.com/NebulousLabs/merkletree"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 const (
@@ -15,44 +28,670 @@ const (
 	// bytes, would result in substantially faster hashing, but the bandwidth
 	// tradeoff was deemed to be more important, as blockchain space is scarce.
 	SegmentSize = 64
+
+	// LeafHashPrefix is the byte prepended to the data of a leaf before it is
+	// hashed, and NodeHashPrefix is the byte prepended to the concatenated
+	// hashes of two children before they are hashed. Both are hashed with
+	// blake2b-256. They are the same as those used by the merkletree package,
+	// and distinguish leaves from interior nodes so that one cannot be passed
+	// off as the other.
+	LeafHashPrefix = 0x00
+	NodeHashPrefix = 0x01
+
+	// parallelChunkSize is the number of bytes hashed by each unit of work in
+	// ReaderMerkleRootParallel. It must be a power-of-two multiple of
+	// SegmentSize, so that every chunk except the last is a complete subtree.
+	parallelChunkSize = SegmentSize << 12
+
+	// bufferedReadSize is the size of the reads made by
+	// BufferedReaderMerkleRoot. A read may still end partway through a
+	// segment, since the underlying reader can return less than was asked
+	// for; readSegments reassembles such segments, so the size only affects
+	// performance.
+	bufferedReadSize = SegmentSize << 10
+
+	// maxStateSegmentSize is the largest segment size accepted by
+	// UnmarshalTreeState. It is the size of a sector, far larger than any
+	// segment size in use, and it keeps a corrupt state from causing a huge
+	// allocation when segments are read.
+	maxStateSegmentSize = 1 << 22
+
+	// mmapChunkSize is the number of bytes of a memory-mapped file that are
+	// hashed before the pages backing them are released.
+	mmapChunkSize = 1 << 20
+
+	// progressInterval is the number of bytes hashed by
+	// ReaderMerkleRootProgress between calls to its progress callback. It is a
+	// multiple of SegmentSize.
+	progressInterval = 1 << 22
+)
+
+var (
+	// ErrInvalidRange is returned when a requested range of segments is empty
+	// or extends past the end of the data.
+	ErrInvalidRange = errors.New("segment range is empty or out of bounds")
+
+	// ErrIndexOutOfRange is returned when a proof index is not less than the
+	// number of leaves in the tree.
+	ErrIndexOutOfRange = errors.New("proof index is out of range")
+
+	// ErrProofWrongLength is returned when a proof does not contain the
+	// number of hashes required for its index and number of leaves.
+	ErrProofWrongLength = errors.New("proof has the wrong number of hashes")
+
+	// ErrRootMismatch is returned when a proof is well formed, but does not
+	// produce the expected Merkle root.
+	ErrRootMismatch = errors.New("proof does not match the Merkle root")
+
+	// ErrSegmentTooLarge is returned when a segment larger than the tree's
+	// segment size is pushed.
+	ErrSegmentTooLarge = errors.New("segment is larger than the tree's segment size")
+
+	// ErrTreeTooLarge is returned when pushing a leaf onto a bounded tree
+	// would make the tree taller than its maximum height.
+	ErrTreeTooLarge = errors.New("tree would exceed its maximum height")
+
+	// ErrInvalidSegmentSize is returned when a segment size that is not
+	// positive is requested.
+	ErrInvalidSegmentSize = errors.New("segment size must be positive")
+
+	// errShortSegment is returned when a segment shorter than SegmentSize is
+	// followed by another segment.
+	errShortSegment = errors.New("only the final segment may be shorter than SegmentSize")
+
+	// errMmapUnsupported is returned when memory-mapping files is not
+	// supported on the current platform.
+	errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+	// errBadTreeState is returned when a marshalled tree state does not hold
+	// one subtree root for every bit set in its number of leaves.
+	errBadTreeState = errors.New("tree state has the wrong number of subtrees")
+
+	// errHasherTreeState is returned when trying to marshal the state of a
+	// tree that uses a custom hasher, which cannot be persisted.
+	errHasherTreeState = errors.New("cannot marshal the state of a tree with a custom hasher")
+
+	// errProofTreeState is returned when trying to marshal the state of a
+	// tree that is building a proof.
+	errProofTreeState = errors.New("cannot marshal the state of a tree that is building a proof")
+
+	// errSubtreesNotCached is returned when converting a tree to a cached
+	// tree with a subtree height that was not passed to CacheSubtrees.
+	errSubtreesNotCached = errors.New("tree did not cache subtree roots of the requested height")
+
+	// errUnalignedMerge is returned when merging two trees where the leaves
+	// of the second tree do not form aligned subtrees after the first.
+	errUnalignedMerge = errors.New("first tree's leaf count is not aligned with the second tree's subtrees")
+
+	// errIncompatibleMerge is returned when merging two trees that are
+	// building proofs or that hash their leaves differently.
+	errIncompatibleMerge = errors.New("cannot merge trees that are building proofs or use custom hashers")
+
+	// leafHashPrefix and nodeHashPrefix hold LeafHashPrefix and
+	// NodeHashPrefix, for writing to a hasher.
+	leafHashPrefix = []byte{LeafHashPrefix}
+	nodeHashPrefix = []byte{NodeHashPrefix}
 )
 
-// MerkleTree wraps merkletree.Tree, changing some of the function definitions
-// to assume sia-specific constants and return sia-specific types.
+// ctxReader is an io.Reader that stops returning data once its context is
+// cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader.
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// subtree is the root of a perfect subtree of a Merkle tree. A subtree of
+// height h covers the 1<<h leaves starting at leaf 'index', and 'index' is
+// always a multiple of 1<<h.
+type subtree struct {
+	index  uint64
+	height uint64
+	sum    Hash
+}
+
+// subtreeStack holds the roots of the subtrees that make up a partially built
+// Merkle tree, ordered from left to right. Subtrees must be pushed in order,
+// and two adjacent subtrees are joined as soon as they form a parent that is
+// itself aligned.
+type subtreeStack []subtree
+
+// leafStack is a subtreeStack for leaves pushed from index 0, held in a
+// fixed-size array so that it never needs to be allocated. The stack holds at
+// most one subtree per bit of the leaf count, so 64 entries are enough, and
+// two adjacent subtrees of equal height can always be joined.
+type leafStack struct {
+	sums    [64]Hash
+	heights [64]uint64
+	n       int
+}
+
+// MerkleTree is a Merkle tree that assumes sia-specific constants and returns
+// sia-specific types. Leaves and nodes are hashed exactly as they are by
+// merkletree.Tree, so the roots and proofs produced are identical. Unlike
+// merkletree.Tree, the state of a MerkleTree can be inspected and persisted.
+//
+// MerkleTree used to embed merkletree.Tree, and no longer does. Push, Prove,
+// ReadAll, Root and SetIndex behave as before, but the embedded Tree field is
+// gone. ProveHashSet returns the same proof as Prove in Sia types.
 type MerkleTree struct {
-	merkletree.Tree
+	stack       subtreeStack
+	numLeaves   uint64
+	segmentSize int
+
+	// hasher is used in place of blake2b if it is not nil.
+	hasher hash.Hash
+
+	// A bounded tree holds at most 1<<maxHeight leaves.
+	bounded   bool
+	maxHeight uint64
+
+	// If cacheTree is set, the root of every subtree of height cacheHeight
+	// is kept in cachedRoots, for ToCachedTree.
+	cacheTree   bool
+	cacheHeight uint64
+	cachedRoots []Hash
+
+	// Proof state. proofSiblings contains the siblings of the subtree that
+	// holds the proof leaf, from the bottom of the tree to the top.
+	proofTree     bool
+	proofIndex    uint64
+	proofBase     []byte
+	proofSiblings []Hash
+}
+
+// merkleTreeState is the persisted form of a MerkleTree. The heights of the
+// subtrees in the stack are implied by the number of leaves, so only the
+// subtree roots are stored.
+type merkleTreeState struct {
+	NumLeaves   uint64
+	SegmentSize uint64
+	Subtrees    []Hash
 }
 
 // NewTree returns a MerkleTree, which can be used for getting Merkle roots and
-// Merkle proofs on data. See merkletree.Tree for more details.
+// Merkle proofs on data.
 func NewTree() *MerkleTree {
-	return &MerkleTree{*merkletree.New(NewHash())}
+	return NewTreeWithSegmentSize(SegmentSize)
+}
+
+// NewTreeWithSegmentSize returns a MerkleTree that splits data read from
+// readers into leaves of 'size' bytes instead of SegmentSize. Leaves pushed
+// directly are hashed the same way regardless of the segment size. The size
+// must be positive.
+func NewTreeWithSegmentSize(size int) *MerkleTree {
+	if size <= 0 {
+		panic(ErrInvalidSegmentSize)
+	}
+	return &MerkleTree{segmentSize: size}
+}
+
+// NewBoundedTree returns a MerkleTree whose height may not exceed
+// 'maxStackHeight', so that it holds at most 1<<maxStackHeight leaves and its
+// stack holds at most maxStackHeight+1 subtrees. Pushing a leaf past the limit
+// with PushObject, PushEncoded, PushSegment, PushReader or ReadAll returns
+// ErrTreeTooLarge. Push does not check the limit, so leaves from untrusted
+// sources should be pushed with one of those methods instead.
+func NewBoundedTree(maxStackHeight int) *MerkleTree {
+	if maxStackHeight < 0 {
+		panic("maxStackHeight must not be negative")
+	}
+	t := NewTree()
+	t.bounded = true
+	t.maxHeight = uint64(maxStackHeight)
+	return t
+}
+
+// NewTreeHasher returns a MerkleTree that hashes its leaves and nodes with 'h'
+// instead of blake2b. The leaf and node prefixes are the same as for the
+// default tree, so that other implementations using the same hash can
+// reproduce its roots. 'h' must produce HashSize-byte digests.
+//
+// Sia itself only uses blake2b; this is intended for interoperating with
+// external tools.
+func NewTreeHasher(h hash.Hash) *MerkleTree {
+	if h.Size() != HashSize {
+		panic(ErrHashWrongLen)
+	}
+	t := NewTree()
+	t.hasher = h
+	return t
+}
+
+// MergeTrees returns a new tree holding the leaves of 'a' followed by the
+// leaves of 'b', without rehashing them. Every subtree of 'b' must be aligned
+// once it is placed after 'a', which is the case when the number of leaves in
+// 'a' is a multiple of the largest power of two not greater than the number of
+// leaves in 'b'. Trees that are building proofs or use custom hashers cannot
+// be merged. Neither 'a' nor 'b' is modified.
+func MergeTrees(a, b *MerkleTree) (*MerkleTree, error) {
+	if a.proofTree || b.proofTree || a.hasher != nil || b.hasher != nil || a.segmentSize != b.segmentSize {
+		return nil, errIncompatibleMerge
+	}
+	for _, st := range b.stack {
+		if (a.numLeaves>>st.height)<<st.height != a.numLeaves {
+			return nil, errUnalignedMerge
+		}
+	}
+	t := NewTreeWithSegmentSize(a.segmentSize)
+	t.stack = append(t.stack, a.stack...)
+	for _, st := range b.stack {
+		st.index += a.numLeaves
+		t.stack.push(st)
+	}
+	t.numLeaves = a.numLeaves + b.numLeaves
+	return t, nil
+}
+
+// UnmarshalTreeState returns a MerkleTree that resumes from a state produced
+// by MarshalState. Pushing the remaining leaves onto the returned tree results
+// in the same root as pushing every leaf onto a single tree.
+func UnmarshalTreeState(b []byte) (*MerkleTree, error) {
+	var state merkleTreeState
+	if err := encoding.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	if state.SegmentSize == 0 || state.SegmentSize > maxStateSegmentSize {
+		return nil, ErrInvalidSegmentSize
+	}
+
+	// The stack holds one subtree for every bit set in the number of leaves,
+	// largest first.
+	t := NewTreeWithSegmentSize(int(state.SegmentSize))
+	for height := uint64(64); height > 0; height-- {
+		if state.NumLeaves&(1<<(height-1)) == 0 {
+			continue
+		}
+		if len(state.Subtrees) == 0 {
+			return nil, errBadTreeState
+		}
+		t.stack = append(t.stack, subtree{
+			index:  t.numLeaves,
+			height: height - 1,
+			sum:    state.Subtrees[0],
+		})
+		t.numLeaves += 1 << (height - 1)
+		state.Subtrees = state.Subtrees[1:]
+	}
+	if len(state.Subtrees) != 0 {
+		return nil, errBadTreeState
+	}
+	return t, nil
+}
+
+// ExtendRoot returns the Merkle root of a tree after the data in 'newData' is
+// appended to it, given the state of the tree from MarshalState. Only the
+// appended leaves are hashed. The result only matches a full recomputation if
+// the data covered by 'existingState' is a whole number of segments, because
+// a short final leaf cannot be extended.
+func ExtendRoot(existingState []byte, newData io.Reader) (Hash, error) {
+	t, err := UnmarshalTreeState(existingState)
+	if err != nil {
+		return Hash{}, err
+	}
+	if err := t.readAll(newData); err != nil {
+		return Hash{}, err
+	}
+	return t.Root(), nil
+}
+
+// CacheSubtrees makes the tree keep the root of every subtree of 'height' as
+// it is built, so that it can later be converted with ToCachedTree. Like
+// SetIndex, it must be called before any leaves are pushed. Cached trees
+// always use blake2b, so trees with custom hashers cannot cache subtrees.
+func (t *MerkleTree) CacheSubtrees(height uint64) error {
+	if t.numLeaves != 0 {
+		return errors.New("cannot call CacheSubtrees on Tree if Tree has not been reset")
+	} else if t.hasher != nil {
+		return errors.New("cannot cache the subtrees of a tree with a custom hasher")
+	}
+	t.cacheTree = true
+	t.cacheHeight = height
+	return nil
+}
+
+// Clone returns a deep copy of the tree. Leaves pushed to the copy do not
+// affect the original, so the copy can be used to compute the root the tree
+// would have after some speculative pushes. A custom hasher is shared with the
+// copy, so the two trees must not be used concurrently.
+func (t *MerkleTree) Clone() *MerkleTree {
+	clone := *t
+	clone.stack = append(subtreeStack(nil), t.stack...)
+	clone.cachedRoots = append([]Hash(nil), t.cachedRoots...)
+	clone.proofSiblings = append([]Hash(nil), t.proofSiblings...)
+	return &clone
+}
+
+// MarshalState returns the number of leaves in the tree and the roots of its
+// unfinished subtrees, which is enough to resume building the tree later with
+// UnmarshalTreeState. The state of a tree that is building a proof cannot be
+// marshalled.
+func (t *MerkleTree) MarshalState() ([]byte, error) {
+	if t.proofTree {
+		return nil, errProofTreeState
+	} else if t.hasher != nil {
+		return nil, errHasherTreeState
+	}
+	state := merkleTreeState{
+		NumLeaves:   t.numLeaves,
+		SegmentSize: uint64(t.segmentSize),
+		Subtrees:    make([]Hash, len(t.stack)),
+	}
+	for i, st := range t.stack {
+		state.Subtrees[i] = st.sum
+	}
+	return encoding.Marshal(state), nil
+}
+
+// Prove is a redefinition of merkletree.Tree.Prove. It returns the Merkle
+// root of the tree, and a proof set holding the base segment followed by the
+// hashes of the proof, for the leaf at the index set by SetIndex, along with
+// that index and the number of leaves. If the index has not been reached, the
+// proof set is nil. Most callers want ProveHashSet instead.
+func (t *MerkleTree) Prove() (merkleRoot []byte, proofSet [][]byte, proofIndex uint64, numLeaves uint64) {
+	base, hashSet := t.ProveHashSet()
+	if t.numLeaves != 0 {
+		root := t.Root()
+		merkleRoot = root[:]
+	}
+	if base != nil {
+		proofSet = make([][]byte, len(hashSet)+1)
+		proofSet[0] = base
+		for i := range hashSet {
+			proofSet[i+1] = hashSet[i][:]
+		}
+	}
+	return merkleRoot, proofSet, t.proofIndex, t.numLeaves
+}
+
+// ProveHashSet returns a Merkle proof that the leaf at the index set by
+// SetIndex is a part of the tree, as a base segment and hash set. If the
+// index has not been reached, no proof is returned.
+func (t *MerkleTree) ProveHashSet() (base []byte, hashSet []Hash) {
+	if !t.proofTree {
+		panic("wrong usage: can't call prove on a tree if SetIndex wasn't called")
+	}
+	if t.proofIndex >= t.numLeaves {
+		return nil, nil
+	}
+	hashSet = append([]Hash(nil), t.proofSiblings...)
+
+	// Find the subtree in the stack that contains the proof leaf. Everything
+	// to its right is folded into a single sibling, and everything to its
+	// left is added one subtree at a time, nearest first.
+	k := len(t.stack) - 1
+	for t.stack[k].index > t.proofIndex {
+		k--
+	}
+	if k < len(t.stack)-1 {
+		hashSet = append(hashSet, t.stack[k+1:].rootWith(t.hasher))
+	}
+	for i := k - 1; i >= 0; i-- {
+		hashSet = append(hashSet, t.stack[i].sum)
+	}
+	return t.proofBase, hashSet
+}
+
+// Push adds a leaf to the tree. It does not check the limit of a bounded
+// tree; see NewBoundedTree.
+func (t *MerkleTree) Push(data []byte) {
+	if t.proofTree && t.numLeaves == t.proofIndex {
+		t.proofBase = append([]byte(nil), data...)
+	}
+	t.pushHash(leafSumWith(t.hasher, data))
+}
+
+// PushSegment adds a segment of raw data to the tree as a leaf. Unlike Push,
+// it rejects segments that are larger than the tree's segment size.
+func (t *MerkleTree) PushSegment(data []byte) error {
+	if len(data) > t.segmentSize {
+		return ErrSegmentTooLarge
+	} else if err := t.checkBound(); err != nil {
+		return err
+	}
+	t.Push(data)
+	return nil
 }
 
 // PushObject encodes and adds the hash of the encoded object to the tree as a
-// leaf.
-func (t *MerkleTree) PushObject(obj interface{}) {
+// leaf. If the tree is bounded and already full, ErrTreeTooLarge is returned
+// and no leaf is pushed.
+func (t *MerkleTree) PushObject(obj interface{}) error {
+	if err := t.checkBound(); err != nil {
+		return err
+	}
 	t.Push(encoding.Marshal(obj))
+	return nil
 }
 
-// Root is a redefinition of merkletree.Tree.Root, returning a Hash instead of
-// a []byte.
-func (t *MerkleTree) Root() (h Hash) {
-	copy(h[:], t.Tree.Root())
-	return
+// PushEncoded adds the object's own encoding, as written by its MarshalSia
+// method, to the tree as a leaf. Any error from MarshalSia is returned and no
+// leaf is pushed. Since encoding.Marshal also defers to MarshalSia, LeafHash(m)
+// is the leaf hash that PushEncoded(m) pushes, and PushObject(m) pushes the
+// same leaf.
+func (t *MerkleTree) PushEncoded(m encoding.SiaMarshaler) error {
+	if err := t.checkBound(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := m.MarshalSia(&buf); err != nil {
+		return err
+	}
+	t.Push(buf.Bytes())
+	return nil
+}
+
+// PushReader reads 'r' until EOF, pushing each segment of the tree's segment
+// size as a leaf, and returns the number of bytes read. Only the final segment
+// may be short, so if more leaves are pushed afterward, the data in 'r' should
+// be a multiple of the segment size. If the tree is bounded and fills up,
+// ErrTreeTooLarge is returned and no more of 'r' is read.
+func (t *MerkleTree) PushReader(r io.Reader) (n int64, err error) {
+	_, err = readSegmentsSizeErr(r, t.segmentSize, func(segment []byte) error {
+		if err := t.pushBounded(segment); err != nil {
+			return err
+		}
+		n += int64(len(segment))
+		return nil
+	})
+	return n, err
+}
+
+// ReadAll reads 'r' until EOF, pushing each segment of 'segmentSize' bytes as
+// a leaf. Only the final segment may be short. It is the same as
+// merkletree.Tree.ReadAll.
+func (t *MerkleTree) ReadAll(r io.Reader, segmentSize int) error {
+	if segmentSize <= 0 {
+		return ErrInvalidSegmentSize
+	}
+	_, err := readSegmentsSizeErr(r, segmentSize, t.pushBounded)
+	return err
+}
+
+// Reset returns the tree to its initial state, clearing its leaves and any
+// proof index, so that it can be reused without reallocating its stack. The
+// segment size and hasher of the tree are kept.
+func (t *MerkleTree) Reset() {
+	t.stack = t.stack[:0]
+	t.numLeaves = 0
+	t.proofTree = false
+	t.proofIndex = 0
+	t.proofBase = nil
+	t.proofSiblings = t.proofSiblings[:0]
+	t.cacheTree = false
+	t.cacheHeight = 0
+	t.cachedRoots = t.cachedRoots[:0]
+}
+
+// Root returns the Merkle root of the leaves that have been pushed so far, as
+// if they were the whole tree. Root does not finalize the tree, so it can be
+// used to query progress: more leaves may be pushed afterward, and a proof
+// being built is not affected.
+func (t *MerkleTree) Root() Hash {
+	return t.stack.rootWith(t.hasher)
+}
+
+// SetIndex sets the index of the leaf that Prove will build a proof for. It
+// must be called before any leaves are pushed.
+func (t *MerkleTree) SetIndex(i uint64) error {
+	if t.numLeaves != 0 {
+		return errors.New("cannot call SetIndex on Tree if Tree has not been reset")
+	}
+	t.proofTree = true
+	t.proofIndex = i
+	return nil
+}
+
+// checkBound returns ErrTreeTooLarge if the tree is bounded and another leaf
+// would make it taller than its maximum height.
+func (t *MerkleTree) checkBound() error {
+	if t.bounded && t.maxHeight < 64 && t.numLeaves >= 1<<t.maxHeight {
+		return ErrTreeTooLarge
+	}
+	return nil
+}
+
+// ToCachedTree returns a CachedMerkleTree built from the roots of the
+// subtrees of 'subtreeHeight' that make up the tree, which must have been
+// requested with CacheSubtrees. If the final subtree is incomplete, the root
+// of its leaves is used. The root of the cached tree is the same as the root
+// of the tree.
+func (t *MerkleTree) ToCachedTree(subtreeHeight uint64) (*CachedMerkleTree, error) {
+	if !t.cacheTree || t.cacheHeight != subtreeHeight {
+		return nil, errSubtreesNotCached
+	}
+	ct := NewCachedTreeWithSegmentSize(subtreeHeight, t.segmentSize)
+	for _, h := range t.cachedRoots {
+		ct.Push(h)
+	}
+	for i, st := range t.stack {
+		if st.height < subtreeHeight {
+			ct.Push(t.stack[i:].root())
+			break
+		}
+	}
+	return ct, nil
+}
+
+// pushHash adds a leaf whose hash has already been computed to the tree.
+func (t *MerkleTree) pushHash(h Hash) {
+	if t.cacheTree && t.cacheHeight == 0 {
+		t.cachedRoots = append(t.cachedRoots, h)
+	}
+	t.stack.pushWith(subtree{index: t.numLeaves, sum: h}, t.hasher, t.joined)
+	t.numLeaves++
+}
+
+// joined is called whenever two subtrees are joined, recording the proof
+// sibling and the cached subtree root that the join produces, if any.
+func (t *MerkleTree) joined(left, right subtree) {
+	t.recordSibling(left, right)
+	if t.cacheTree && left.height+1 == t.cacheHeight {
+		t.cachedRoots = append(t.cachedRoots, nodeSumWith(t.hasher, left.sum, right.sum))
+	}
+}
+
+// pushBounded is the same as Push, but returns ErrTreeTooLarge instead of
+// pushing if the tree is bounded and already full.
+func (t *MerkleTree) pushBounded(data []byte) error {
+	if err := t.checkBound(); err != nil {
+		return err
+	}
+	t.Push(data)
+	return nil
+}
+
+// readAll reads 'r' until EOF, pushing each segment of the tree's segment size
+// as a leaf.
+func (t *MerkleTree) readAll(r io.Reader) error {
+	_, err := readSegmentsSizeErr(r, t.segmentSize, t.pushBounded)
+	return err
+}
+
+// recordSibling is called whenever two subtrees are joined. If one of the
+// subtrees contains the proof leaf, the other is added to the proof.
+func (t *MerkleTree) recordSibling(left, right subtree) {
+	if !t.proofTree || t.proofIndex < left.index || (t.proofIndex-left.index)>>(left.height+1) != 0 {
+		return
+	} else if t.proofIndex < right.index {
+		t.proofSiblings = append(t.proofSiblings, right.sum)
+	} else {
+		t.proofSiblings = append(t.proofSiblings, left.sum)
+	}
 }
 
 // CachedMerkleTree wraps merkletree.CachedTree, changing some of the function
 // definitions to assume sia-specific constants and return sia-specific types.
+//
+// Every subtree root pushed onto the tree is kept in memory, one Hash per
+// subtree, so that ProveMulti and Prover can build proofs after the subtrees
+// have been pushed.
 type CachedMerkleTree struct {
 	merkletree.CachedTree
+
+	// The height of the cached subtrees and their roots are kept so that
+	// proofs can be built after the subtrees have been pushed.
+	height   uint64
+	subtrees []Hash
+
+	// segmentSize is the size of the leaves that the cached subtrees were
+	// built from.
+	segmentSize int
+}
+
+// CachedSubProof is a proof that a leaf is a part of a single cached subtree.
+// Index is the index of the leaf within the full tree, not the subtree.
+type CachedSubProof struct {
+	Index         uint64
+	Base          []byte
+	CachedHashSet []Hash
 }
 
 // NewCachedTree returns a CachedMerkleTree, which can be used for getting
 // Merkle roots and proofs from data that has cached subroots. See
 // merkletree.CachedTree for more details.
 func NewCachedTree(height uint64) *CachedMerkleTree {
-	return &CachedMerkleTree{*merkletree.NewCachedTree(NewHash(), height)}
+	return NewCachedTreeWithSegmentSize(height, SegmentSize)
+}
+
+// NewCachedTreeWithSegmentSize returns a CachedMerkleTree whose cached
+// subtrees were built from leaves of 'size' bytes instead of SegmentSize. The
+// size must be positive.
+func NewCachedTreeWithSegmentSize(height uint64, size int) *CachedMerkleTree {
+	if size <= 0 {
+		panic(ErrInvalidSegmentSize)
+	}
+	return &CachedMerkleTree{
+		CachedTree:  *merkletree.NewCachedTree(NewHash(), height),
+		height:      height,
+		segmentSize: size,
+	}
+}
+
+// Compatible reports whether cached proofs from 'ct' and 'other' describe
+// trees with the same layout, so that they can be combined. Cached trees
+// always use blake2b, so the subtree heights and segment sizes need to match.
+func (ct *CachedMerkleTree) Compatible(other *CachedMerkleTree) bool {
+	return ct.height == other.height && ct.segmentSize == other.segmentSize
+}
+
+// GlobalIndex returns the index within the full tree of the leaf at
+// 'leafWithinSubtree' in the cached subtree at 'subtreeIndex'.
+func (ct *CachedMerkleTree) GlobalIndex(subtreeIndex, leafWithinSubtree uint64) uint64 {
+	return subtreeIndex<<ct.height + leafWithinSubtree
+}
+
+// NumSubtrees returns the number of cached subtree roots that have been pushed
+// onto the tree.
+func (ct *CachedMerkleTree) NumSubtrees() uint64 {
+	return uint64(len(ct.subtrees))
 }
 
 // Prove is a redefinition of merkletree.CachedTree.Prove, so that Sia-specific
@@ -76,10 +715,80 @@ func (ct *CachedMerkleTree) Prove(base []byte, cachedHashSet []Hash) []Hash {
 	return hashSet
 }
 
+// ProveMulti extends each of the cached proofs into a proof for the full tree,
+// reusing the subtree roots that have already been pushed. The tree above the
+// cached subtrees is built once per call, holding about twice as many hashes
+// as there are subtrees, and each proof's siblings are read from it. The
+// result for a proof whose index lies outside the pushed subtrees is nil.
+// Unlike Prove, ProveMulti does not require SetIndex to be called.
+func (ct *CachedMerkleTree) ProveMulti(proofs []CachedSubProof) [][]Hash {
+	return ct.Prover().proveMulti(proofs)
+}
+
+// Prover returns a ReadOnlyProver holding a snapshot of the tree above the
+// subtrees pushed so far, which uses about twice as much memory as the
+// subtree roots themselves. Subtrees pushed afterward are not seen by the
+// prover.
+func (ct *CachedMerkleTree) Prover() *ReadOnlyProver {
+	return &ReadOnlyProver{
+		height: ct.height,
+		levels: newTreeLevels(ct.subtrees),
+	}
+}
+
+// A ReadOnlyProver extends cached proofs into proofs for the full tree, like
+// CachedMerkleTree.ProveMulti. It is never modified after it is created, so
+// Prove may be called from multiple goroutines at once.
+type ReadOnlyProver struct {
+	height uint64
+	levels treeLevels
+}
+
+// Prove extends a proof for a leaf of a cached subtree into a proof for the
+// full tree. No hashing is done. If the leaf lies outside the cached
+// subtrees, nil is returned.
+func (rp *ReadOnlyProver) Prove(p CachedSubProof) []Hash {
+	subtreeIndex := p.Index >> rp.height
+	if subtreeIndex >= rp.levels.numLeaves {
+		return nil
+	}
+	return append(append([]Hash(nil), p.CachedHashSet...), rp.levels.proof(subtreeIndex)...)
+}
+
+// proveMulti calls Prove on each of 'proofs'.
+func (rp *ReadOnlyProver) proveMulti(proofs []CachedSubProof) [][]Hash {
+	hashSets := make([][]Hash, len(proofs))
+	for i, p := range proofs {
+		hashSets[i] = rp.Prove(p)
+	}
+	return hashSets
+}
+
 // Push is a redefinition of merkletree.CachedTree.Push, with the added type
 // safety of only accepting a hash.
 func (ct *CachedMerkleTree) Push(h Hash) {
 	ct.CachedTree.Push(h[:])
+	ct.subtrees = append(ct.subtrees, h)
+}
+
+// PushAllFrom reads subtree roots from 'r' until EOF, pushing each one onto
+// the tree. The number of roots pushed is returned. If the data in 'r' is not
+// a multiple of HashSize, every complete root is pushed and ErrHashWrongLen is
+// returned.
+func (ct *CachedMerkleTree) PushAllFrom(r io.Reader) (n int, err error) {
+	var h Hash
+	for {
+		_, err := io.ReadFull(r, h[:])
+		if err == io.EOF {
+			return n, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return n, ErrHashWrongLen
+		} else if err != nil {
+			return n, err
+		}
+		ct.Push(h)
+		n++
+	}
 }
 
 // Root is a redefinition of merkletree.CachedTree.Root, returning a Hash
@@ -89,8 +798,224 @@ func (ct *CachedMerkleTree) Root() (h Hash) {
 	return
 }
 
+// Verify verifies a proof produced by Prove or ProveMulti for the leaf at
+// 'globalIndex' of the full tree against the root of the cached tree. Every
+// cached subtree is assumed to be full, so that the full tree has
+// NumSubtrees()<<SubtreeHeight() leaves.
+func (ct *CachedMerkleTree) Verify(base []byte, hashSet []Hash, globalIndex uint64) bool {
+	return VerifySegment(base, hashSet, ct.NumSubtrees()<<ct.height, globalIndex, ct.Root())
+}
+
+// SubtreeHeight returns the height of the cached subtrees. Each cached subtree
+// contains 1<<SubtreeHeight() leaves.
+func (ct *CachedMerkleTree) SubtreeHeight() uint64 {
+	return ct.height
+}
+
+// push adds a subtree to the right side of the stack, joining it with its
+// neighbors wherever possible.
+func (s *subtreeStack) push(st subtree) {
+	s.pushWith(st, nil, nil)
+}
+
+// pushWith is the same as push, but joins subtrees using 'hasher' if it is not
+// nil, and calls fn, if it is not nil, on each pair of subtrees before they
+// are joined.
+func (s *subtreeStack) pushWith(st subtree, hasher hash.Hash, fn func(left, right subtree)) {
+	*s = append(*s, st)
+	for len(*s) > 1 {
+		left, right := (*s)[len(*s)-2], (*s)[len(*s)-1]
+		// The parent is only aligned if the left subtree is the left child,
+		// meaning bit 'height' of its index is not set.
+		if left.height != right.height || (left.index>>left.height)&1 != 0 {
+			break
+		}
+		if fn != nil {
+			fn(left, right)
+		}
+		*s = append((*s)[:len(*s)-2], subtree{
+			index:  left.index,
+			height: left.height + 1,
+			sum:    nodeSumWith(hasher, left.sum, right.sum),
+		})
+	}
+}
+
+// push adds the leaf hash 'h' to the right side of the stack, joining it with
+// its neighbors wherever possible.
+func (s *leafStack) push(h Hash) {
+	s.sums[s.n], s.heights[s.n] = h, 0
+	s.n++
+	for s.n > 1 && s.heights[s.n-2] == s.heights[s.n-1] {
+		s.sums[s.n-2] = nodeSum(s.sums[s.n-2], s.sums[s.n-1])
+		s.heights[s.n-2]++
+		s.n--
+	}
+}
+
+// root returns the Merkle root of the leaves pushed so far, or the zero hash
+// if none have been pushed.
+func (s *leafStack) root() Hash {
+	if s.n == 0 {
+		return Hash{}
+	}
+	h := s.sums[s.n-1]
+	for i := s.n - 2; i >= 0; i-- {
+		h = nodeSum(s.sums[i], h)
+	}
+	return h
+}
+
+// reset empties the stack.
+func (s *leafStack) reset() {
+	s.n = 0
+}
+
+// root folds the stack from right to left, producing the Merkle root of all
+// the leaves covered by the stack. The empty stack has the zero hash as its
+// root, matching merkletree.Tree.
+func (s subtreeStack) root() (h Hash) {
+	return s.rootWith(nil)
+}
+
+// rootWith is the same as root, but joins subtrees using 'hasher' if it is not
+// nil.
+func (s subtreeStack) rootWith(hasher hash.Hash) (h Hash) {
+	if len(s) == 0 {
+		return Hash{}
+	}
+	h = s[len(s)-1].sum
+	for i := len(s) - 2; i >= 0; i-- {
+		h = nodeSumWith(hasher, s[i].sum, h)
+	}
+	return h
+}
+
+// leafSum returns the hash of a leaf of the Merkle tree.
+func leafSum(data []byte) Hash {
+	// Leaves are almost always a single segment, which can be hashed without
+	// allocating.
+	if len(data) <= SegmentSize {
+		var buf [1 + SegmentSize]byte
+		buf[0] = LeafHashPrefix
+		n := copy(buf[1:], data)
+		return Hash(blake2b.Sum256(buf[:1+n]))
+	}
+	var h Hash
+	hasher := NewHash()
+	hasher.Write(leafHashPrefix)
+	hasher.Write(data)
+	hasher.Sum(h[:0])
+	return h
+}
+
+// nodeSum returns the hash of an interior node of the Merkle tree, given the
+// hashes of its children.
+func nodeSum(left, right Hash) Hash {
+	var buf [1 + 2*HashSize]byte
+	buf[0] = NodeHashPrefix
+	copy(buf[1:], left[:])
+	copy(buf[1+HashSize:], right[:])
+	return Hash(blake2b.Sum256(buf[:]))
+}
+
+// leafSumWith is the same as leafSum, but uses 'hasher' if it is not nil.
+func leafSumWith(hasher hash.Hash, data []byte) (h Hash) {
+	if hasher == nil {
+		return leafSum(data)
+	}
+	hasher.Reset()
+	hasher.Write(leafHashPrefix)
+	hasher.Write(data)
+	hasher.Sum(h[:0])
+	return h
+}
+
+// nodeSumWith is the same as nodeSum, but uses 'hasher' if it is not nil.
+func nodeSumWith(hasher hash.Hash, left, right Hash) (h Hash) {
+	if hasher == nil {
+		return nodeSum(left, right)
+	}
+	hasher.Reset()
+	hasher.Write(nodeHashPrefix)
+	hasher.Write(left[:])
+	hasher.Write(right[:])
+	hasher.Sum(h[:0])
+	return h
+}
+
+// nextSubtreeHeight returns the height of the largest aligned subtree that
+// starts at leaf 'start' and does not extend past leaf 'end'. 'start' must be
+// less than 'end'.
+func nextSubtreeHeight(start, end uint64) uint64 {
+	height := uint64(0)
+	for height < 63 && (start>>height)&1 == 0 && end-start >= 2<<height {
+		height++
+	}
+	return height
+}
+
+// readSegments reads 'r' in SegmentSize chunks until EOF, calling fn on each
+// segment. Only the final segment may be shorter than SegmentSize. The slice
+// passed to fn is reused, and is only valid until fn returns. The number of
+// segments read is returned.
+func readSegments(r io.Reader, fn func(segment []byte)) (numSegments uint64, err error) {
+	return readSegmentsSize(r, SegmentSize, fn)
+}
+
+// readSegmentsAt is the same as readSegments, but reads the first 'size' bytes
+// of 'r' in blocks of bufferedReadSize, so that reading a file does not take a
+// system call per segment. If 'r' holds fewer than 'size' bytes,
+// io.ErrUnexpectedEOF is returned.
+func readSegmentsAt(r io.ReaderAt, size int64, fn func(segment []byte)) (numSegments uint64, err error) {
+	var n int64
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, size), bufferedReadSize)
+	numSegments, err = readSegments(br, func(segment []byte) {
+		n += int64(len(segment))
+		fn(segment)
+	})
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return numSegments, err
+}
+
+// readSegmentsSize is the same as readSegments, but reads segments of
+// 'segmentSize' bytes.
+func readSegmentsSize(r io.Reader, segmentSize int, fn func(segment []byte)) (numSegments uint64, err error) {
+	return readSegmentsSizeErr(r, segmentSize, func(segment []byte) error {
+		fn(segment)
+		return nil
+	})
+}
+
+// readSegmentsSizeErr is the same as readSegmentsSize, but stops reading and
+// returns the error if fn returns one. The segment that fn rejected is not
+// counted.
+func readSegmentsSizeErr(r io.Reader, segmentSize int, fn func(segment []byte) error) (numSegments uint64, err error) {
+	buf := make([]byte, segmentSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return numSegments, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return numSegments, err
+		}
+		if err := fn(buf[:n]); err != nil {
+			return numSegments, err
+		}
+		numSegments++
+		if n < segmentSize {
+			return numSegments, nil
+		}
+	}
+}
+
 // CalculateLeaves calculates the number of leaves that would be pushed from
-// data of size 'dataSize'.
+// data of size 'dataSize'. Empty data is counted as a single leaf; this is a
+// historical convention that callers depend on, not a real leaf. No leaves are
+// actually pushed for empty data, its root is EmptyRoot, and no proof exists
+// for it.
 func CalculateLeaves(dataSize uint64) uint64 {
 	numSegments := dataSize / SegmentSize
 	if dataSize == 0 || dataSize%SegmentSize != 0 {
@@ -99,6 +1024,216 @@ func CalculateLeaves(dataSize uint64) uint64 {
 	return numSegments
 }
 
+// TreeHeight returns the height of the Merkle tree with 'numLeaves' leaves,
+// which is ceil(log2(numLeaves)). Trees with 0 or 1 leaves have height 0.
+func TreeHeight(numLeaves uint64) uint64 {
+	var height uint64
+	for height < 64 && 1<<height < numLeaves {
+		height++
+	}
+	return height
+}
+
+// BytesForLeaves returns the number of bytes needed to hold 'numLeaves' full
+// leaves. It is the inverse of CalculateLeaves when the data size is a
+// multiple of SegmentSize, and an upper bound otherwise.
+func BytesForLeaves(numLeaves uint64) uint64 {
+	return numLeaves * SegmentSize
+}
+
+// LeafRange returns the byte offsets [start, end) of the leaf at 'index'. If
+// the leaf is the final leaf of a file, 'end' may lie past the end of the
+// file.
+func LeafRange(index uint64) (start, end uint64) {
+	return index * SegmentSize, (index + 1) * SegmentSize
+}
+
+// IsLastLeaf reports whether the leaf at 'index' is the final leaf of a tree
+// with 'numLeaves' leaves, which is the only leaf that may hold fewer than
+// SegmentSize bytes. The final leaf is not padded; its base segment is simply
+// shorter.
+func IsLastLeaf(numLeaves, index uint64) bool {
+	return numLeaves > 0 && index == numLeaves-1
+}
+
+// LastLeafSize returns the number of bytes in the final leaf of a file of
+// 'totalSize' bytes. The final leaf of empty data holds no bytes.
+func LastLeafSize(totalSize uint64) uint64 {
+	if totalSize%SegmentSize == 0 && totalSize != 0 {
+		return SegmentSize
+	}
+	return totalSize % SegmentSize
+}
+
+// FoldRoots builds a Merkle tree whose leaves are 'roots', and returns its
+// root along with a proof for each of the input roots. Each root is hashed as
+// a leaf, so proofs[i] verifies with VerifySegment(roots[i][:], proofs[i],
+// uint64(len(roots)), i, root). Every hash in the tree is computed only once.
+func FoldRoots(roots []Hash) (root Hash, proofs [][]Hash) {
+	if len(roots) == 0 {
+		return Hash{}, nil
+	}
+	leaves := make([]Hash, len(roots))
+	for i := range roots {
+		leaves[i] = leafSum(roots[i][:])
+	}
+	tl := newTreeLevels(leaves)
+	proofs = make([][]Hash, len(roots))
+	for i := range proofs {
+		proofs[i] = tl.proof(uint64(i))
+	}
+	return tl.root(), proofs
+}
+
+// treeLevels holds every node of a Merkle tree whose leaf hashes are known,
+// so that a proof for any leaf can be read off without hashing. The tree is
+// stored as its perfect subtrees, largest first, using about twice as many
+// hashes as there are leaves.
+type treeLevels struct {
+	numLeaves uint64
+	subtrees  []levelSubtree
+
+	// rights[i] is the root of subtree i and every subtree to its right.
+	rights []Hash
+}
+
+// levelSubtree is a perfect subtree of a treeLevels. levels[0] holds its leaf
+// hashes, starting at leaf 'start' of the tree, and the final level holds its
+// root.
+type levelSubtree struct {
+	start  uint64
+	levels [][]Hash
+}
+
+// newTreeLevels builds every node of the Merkle tree whose leaf hashes are
+// 'leaves'.
+func newTreeLevels(leaves []Hash) treeLevels {
+	tl := treeLevels{numLeaves: uint64(len(leaves))}
+	var start uint64
+	for height := uint64(64); height > 0; height-- {
+		size := uint64(1) << (height - 1)
+		if tl.numLeaves&size == 0 {
+			continue
+		}
+		levels := [][]Hash{leaves[start : start+size]}
+		for prev := levels[0]; len(prev) > 1; prev = levels[len(levels)-1] {
+			next := make([]Hash, len(prev)/2)
+			for i := range next {
+				next[i] = nodeSum(prev[2*i], prev[2*i+1])
+			}
+			levels = append(levels, next)
+		}
+		tl.subtrees = append(tl.subtrees, levelSubtree{start: start, levels: levels})
+		start += size
+	}
+	if len(tl.subtrees) == 0 {
+		return tl
+	}
+	tl.rights = make([]Hash, len(tl.subtrees))
+	tl.rights[len(tl.subtrees)-1] = tl.top(len(tl.subtrees) - 1)
+	for i := len(tl.subtrees) - 2; i >= 0; i-- {
+		tl.rights[i] = nodeSum(tl.top(i), tl.rights[i+1])
+	}
+	return tl
+}
+
+// top returns the root of subtree 'i'.
+func (tl treeLevels) top(i int) Hash {
+	levels := tl.subtrees[i].levels
+	return levels[len(levels)-1][0]
+}
+
+// root returns the Merkle root of the tree.
+func (tl treeLevels) root() Hash {
+	if len(tl.rights) == 0 {
+		return Hash{}
+	}
+	return tl.rights[0]
+}
+
+// proof returns the hash set of a proof for the leaf at 'index', which must
+// be less than tl.numLeaves. It holds the siblings within the leaf's perfect
+// subtree, then the root of everything to the right, then each subtree to the
+// left.
+func (tl treeLevels) proof(index uint64) []Hash {
+	k := 0
+	for index >= tl.subtrees[k].start+uint64(len(tl.subtrees[k].levels[0])) {
+		k++
+	}
+	st := tl.subtrees[k]
+	var proof []Hash
+	i := index - st.start
+	for _, level := range st.levels[:len(st.levels)-1] {
+		proof = append(proof, level[i^1])
+		i >>= 1
+	}
+	if k+1 < len(tl.subtrees) {
+		proof = append(proof, tl.rights[k+1])
+	}
+	for j := k - 1; j >= 0; j-- {
+		proof = append(proof, tl.top(j))
+	}
+	return proof
+}
+
+// LeafHash returns the leaf hash that PushObject pushes for 'obj', so that
+// leaf hashes can be computed ahead of time. An error is returned if 'obj'
+// cannot be encoded, where PushObject would panic.
+func LeafHash(obj interface{}) (h Hash, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not encode object: %v", r)
+		}
+	}()
+	return leafSum(encoding.Marshal(obj)), nil
+}
+
+// A ProofTemplate holds the encoded form and leaf hash of an object whose
+// position in a tree is not yet known. Once the tree has been built, Complete
+// turns it into a storage proof.
+type ProofTemplate struct {
+	Base []byte
+	Leaf Hash
+}
+
+// LeafProofOf encodes 'obj' and returns the leaf hash that PushObject would
+// push for it, along with a ProofTemplate for proving its inclusion later.
+// Like PushObject, it panics if 'obj' cannot be encoded.
+func LeafProofOf(obj interface{}) (leaf Hash, proofTemplate ProofTemplate) {
+	base := encoding.Marshal(obj)
+	leaf = leafSum(base)
+	return leaf, ProofTemplate{Base: base, Leaf: leaf}
+}
+
+// Complete returns the hash set of a proof that the template's object is the
+// leaf at 'index' of the tree whose leaf hashes are 'leaves'. The proof
+// verifies with VerifySegment(pt.Base, hashSet, uint64(len(leaves)), index,
+// root). ErrIndexOutOfRange is returned if there is no such leaf, and
+// ErrRootMismatch if the leaf at 'index' is not the template's object.
+func (pt ProofTemplate) Complete(leaves []Hash, index uint64) (hashSet []Hash, err error) {
+	if index >= uint64(len(leaves)) {
+		return nil, ErrIndexOutOfRange
+	} else if leaves[index] != pt.Leaf {
+		return nil, ErrRootMismatch
+	}
+	t := NewTree()
+	t.SetIndex(index)
+	for _, h := range leaves {
+		t.pushHash(h)
+	}
+	_, hashSet = t.ProveHashSet()
+	return hashSet, nil
+}
+
+// SegmentHash returns the leaf hash of 'segment', exactly as it is computed
+// when building a tree: blake2b-256 of LeafHashPrefix followed by the segment.
+// Segments are never padded, so the final leaf of data whose size is not a
+// multiple of SegmentSize is hashed as-is, and padding it with zeros produces a
+// different hash.
+func SegmentHash(segment []byte) Hash {
+	return leafSum(segment)
+}
+
 // MerkleRoot returns the Merkle root of the input data.
 func MerkleRoot(b []byte) Hash {
 	t := NewTree()
@@ -109,6 +1244,424 @@ func MerkleRoot(b []byte) Hash {
 	return t.Root()
 }
 
+// MerkleRootOfSegments returns the Merkle root of the concatenation of
+// 'segments'. If every segment but the last is exactly SegmentSize bytes and
+// the last is no larger than SegmentSize, the root is computed without any
+// heap allocation; otherwise the segments are joined and passed to MerkleRoot.
+func MerkleRootOfSegments(segments [][]byte) Hash {
+	for i, seg := range segments {
+		if len(seg) > SegmentSize || (len(seg) < SegmentSize && i != len(segments)-1) {
+			return MerkleRoot(bytes.Join(segments, nil))
+		}
+	}
+	if len(segments) == 0 || len(segments[len(segments)-1]) == 0 {
+		// An empty final segment does not produce a leaf.
+		return MerkleRoot(bytes.Join(segments, nil))
+	}
+
+	var s leafStack
+	for _, seg := range segments {
+		s.push(leafSum(seg))
+	}
+	return s.root()
+}
+
+// MerkleRootOfHashes returns the Merkle root of a tree whose leaves are
+// 'roots', such as the sector roots returned by SectorRoots. Each root is hashed
+// as a leaf, exactly as if its bytes had been pushed to a MerkleTree.
+func MerkleRootOfHashes(roots []Hash) Hash {
+	t := NewTree()
+	for _, h := range roots {
+		t.Push(h[:])
+	}
+	return t.Root()
+}
+
+// BuildHashProof builds a Merkle proof that roots[index] is a part of
+// MerkleRootOfHashes(roots). The proof verifies with VerifySegment, using
+// roots[index][:] as the base segment and len(roots) as the number of
+// segments. To build a proof for every root at once, use FoldRoots.
+func BuildHashProof(roots []Hash, index uint64) (base []byte, hashSet []Hash) {
+	t := NewTree()
+	t.SetIndex(index)
+	for _, h := range roots {
+		t.Push(h[:])
+	}
+	return t.ProveHashSet()
+}
+
+// JoinRoots returns the Merkle root of a tree whose left and right children
+// have the roots 'left' and 'right'. If data is split into pieces of the same
+// power-of-two number of segments, joining adjacent roots pairwise, level by
+// level, produces the Merkle root of the whole data. When the pieces shrink
+// from left to right, as the perfect subtrees of a tree do, the roots must be
+// joined from the right: JoinRoots(a, JoinRoots(b, c)).
+func JoinRoots(left, right Hash) Hash {
+	return nodeSum(left, right)
+}
+
+// TruncatedRoot returns the Merkle root of the first 'keepLeaves' segments of
+// the data in 'fullData', which is the root the data would have if it were
+// truncated to keepLeaves*SegmentSize bytes. Only that much of 'fullData' is
+// read. If 'fullData' holds fewer than 'keepLeaves' segments,
+// io.ErrUnexpectedEOF is returned, and if keepLeaves*SegmentSize bytes cannot
+// be addressed, ErrInvalidRange is returned.
+func TruncatedRoot(fullData io.Reader, keepLeaves uint64) (Hash, error) {
+	if keepLeaves > math.MaxInt64/SegmentSize {
+		return Hash{}, ErrInvalidRange
+	}
+	root, numLeaves, err := ReaderMerkleRootAndLeaves(io.LimitReader(fullData, int64(BytesForLeaves(keepLeaves))))
+	if err != nil {
+		return Hash{}, err
+	} else if numLeaves < keepLeaves {
+		return Hash{}, io.ErrUnexpectedEOF
+	}
+	return root, nil
+}
+
+// TruncatedRootFromSubtrees is the same as TruncatedRoot, but uses the stored
+// roots of the subtrees of height 'subtreeHeight' that make up the data, as
+// pushed to a CachedMerkleTree, instead of re-reading the data. 'keepLeaves'
+// must be a multiple of the subtree size, and no more than the number of
+// leaves covered by 'subtreeRoots'; otherwise ErrInvalidRange is returned.
+func TruncatedRootFromSubtrees(subtreeRoots []Hash, subtreeHeight, keepLeaves uint64) (Hash, error) {
+	if subtreeHeight >= 64 || keepLeaves%(1<<subtreeHeight) != 0 || keepLeaves>>subtreeHeight > uint64(len(subtreeRoots)) {
+		return Hash{}, ErrInvalidRange
+	}
+	return joinSubtreeRoots(subtreeRoots[:keepLeaves>>subtreeHeight], subtreeHeight), nil
+}
+
+// VerifySubtreeRoots returns true if 'fullRoot' is the Merkle root of a tree
+// made of subtrees of height 'subtreeHeight' with the roots 'subtreeRoots',
+// in order. Every subtree except the last must be full.
+func VerifySubtreeRoots(subtreeRoots []Hash, subtreeHeight uint64, fullRoot Hash) bool {
+	if subtreeHeight >= 64 || len(subtreeRoots) == 0 {
+		return false
+	}
+	return rootsEqual(joinSubtreeRoots(subtreeRoots, subtreeHeight), fullRoot)
+}
+
+// joinSubtreeRoots returns the Merkle root of the tree made of consecutive
+// subtrees of height 'height' with the roots 'roots'.
+func joinSubtreeRoots(roots []Hash, height uint64) Hash {
+	var s subtreeStack
+	for i, h := range roots {
+		s.push(subtree{index: uint64(i) << height, height: height, sum: h})
+	}
+	return s.root()
+}
+
+// ZeroSectorRoot returns the Merkle root of 'numLeaves' segments of zeros.
+// The root of 2^k zero segments is the node hash of two copies of the root of
+// 2^(k-1) zero segments, so only O(log n) hashes are computed.
+func ZeroSectorRoot(numLeaves uint64) Hash {
+	if numLeaves == 0 {
+		return Hash{}
+	}
+
+	// Compute the root of each perfect subtree of zeros, then fold the
+	// subtrees of the tree together from the right, smallest first.
+	var zeroRoots [64]Hash
+	zeroRoots[0] = leafSum(make([]byte, SegmentSize))
+	for i := 1; i < 64; i++ {
+		zeroRoots[i] = nodeSum(zeroRoots[i-1], zeroRoots[i-1])
+	}
+	var h Hash
+	first := true
+	for height := uint64(0); height < 64; height++ {
+		if numLeaves&(1<<height) == 0 {
+			continue
+		}
+		if first {
+			h = zeroRoots[height]
+			first = false
+		} else {
+			h = nodeSum(zeroRoots[height], h)
+		}
+	}
+	return h
+}
+
+// EmptyRoot returns the Merkle root of empty data, which is the zero hash. No
+// leaves are pushed for empty data, and a tree with no leaves has the zero hash
+// as its root, matching merkletree.Tree. Empty file contracts commit to this
+// root, so it must not change.
+func EmptyRoot() Hash {
+	return Hash{}
+}
+
+// ReaderMerkleRoot returns the Merkle root of the data in 'r'. The root of
+// empty data is EmptyRoot.
+func ReaderMerkleRoot(r io.Reader) (Hash, error) {
+	return ReaderMerkleRootSegSize(r, SegmentSize)
+}
+
+// BufferedReaderMerkleRoot is the same as ReaderMerkleRoot, but reads 'r' in
+// large blocks instead of one segment at a time. It is much faster for readers
+// where each Read is a system call, such as an *os.File.
+func BufferedReaderMerkleRoot(r io.Reader) (Hash, error) {
+	return ReaderMerkleRoot(bufio.NewReaderSize(r, bufferedReadSize))
+}
+
+// ReaderMerkleRootAndLeaves is the same as ReaderMerkleRoot, but also returns
+// the number of leaves that were read from 'r'.
+func ReaderMerkleRootAndLeaves(r io.Reader) (Hash, uint64, error) {
+	t := NewTree()
+	if err := t.readAll(r); err != nil {
+		return Hash{}, 0, err
+	}
+	return t.Root(), t.numLeaves, nil
+}
+
+// ReaderMerkleTree returns every node of the Merkle tree formed by the data in
+// 'r', level by level. levels[0] holds the leaf hashes, and levels[h][i] is the
+// root of the leaves [i<<h, (i+1)<<h), or of the leaves from i<<h to the end of
+// the data if there are fewer. The final level holds only the Merkle root.
+// Empty data has no levels. The whole tree is held in memory, using about
+// twice as many hashes as there are leaves.
+func ReaderMerkleTree(r io.Reader) ([][]Hash, error) {
+	var leaves []Hash
+	if _, err := readSegments(r, func(segment []byte) {
+		leaves = append(leaves, leafSum(segment))
+	}); err != nil {
+		return nil, err
+	} else if len(leaves) == 0 {
+		return nil, nil
+	}
+	levels := [][]Hash{leaves}
+	for prev := leaves; len(prev) > 1; prev = levels[len(levels)-1] {
+		next := make([]Hash, (len(prev)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(prev) {
+				next[i] = nodeSum(prev[2*i], prev[2*i+1])
+			} else {
+				// A node with no right child is the same as its left child.
+				next[i] = prev[2*i]
+			}
+		}
+		levels = append(levels, next)
+	}
+	return levels, nil
+}
+
+// ReaderMerkleRootCtx is the same as ReaderMerkleRoot, but returns ctx.Err()
+// as soon as 'ctx' is cancelled. The context is checked before every read, so
+// a single read that blocks forever cannot be interrupted.
+func ReaderMerkleRootCtx(ctx context.Context, r io.Reader) (Hash, error) {
+	return ReaderMerkleRoot(ctxReader{ctx, r})
+}
+
+// ReaderMerkleRootProgress is the same as ReaderMerkleRoot, but calls
+// 'onProgress' with the total number of bytes hashed so far after every
+// progressInterval bytes, and once more after the final segment.
+func ReaderMerkleRootProgress(r io.Reader, onProgress func(bytesHashed int64)) (Hash, error) {
+	t := NewTree()
+	var hashed int64
+	_, err := readSegments(r, func(segment []byte) {
+		t.Push(segment)
+		hashed += int64(len(segment))
+		if hashed%progressInterval == 0 {
+			onProgress(hashed)
+		}
+	})
+	if err != nil {
+		return Hash{}, err
+	}
+	if hashed%progressInterval != 0 || hashed == 0 {
+		onProgress(hashed)
+	}
+	return t.Root(), nil
+}
+
+// ChannelMerkleRoot returns the Merkle root of the segments received on 'ch',
+// pushing each as a leaf until the channel is closed. Every segment must be
+// SegmentSize bytes, except the last, which may be shorter. If a segment is
+// too large, or a short segment is followed by another, an error is returned
+// once the channel is closed; the remaining segments are drained so that the
+// sender is never blocked.
+func ChannelMerkleRoot(ch <-chan []byte) (Hash, error) {
+	t := NewTree()
+	var err error
+	short := false
+	for segment := range ch {
+		if err != nil {
+			continue
+		} else if len(segment) > SegmentSize {
+			err = ErrSegmentTooLarge
+			continue
+		} else if short {
+			err = errShortSegment
+			continue
+		}
+		short = len(segment) < SegmentSize
+		if len(segment) > 0 {
+			t.Push(segment)
+		}
+	}
+	if err != nil {
+		return Hash{}, err
+	}
+	return t.Root(), nil
+}
+
+// ReaderMerkleRootSegSize returns the Merkle root of the data in 'r', using
+// leaves of 'segmentSize' bytes.
+func ReaderMerkleRootSegSize(r io.Reader, segmentSize int) (Hash, error) {
+	if segmentSize <= 0 {
+		return Hash{}, ErrInvalidSegmentSize
+	}
+	t := NewTreeWithSegmentSize(segmentSize)
+	if err := t.readAll(r); err != nil {
+		return Hash{}, err
+	}
+	return t.Root(), nil
+}
+
+// ReaderMerkleRootHasher returns the Merkle root of the data in 'r', using
+// hashers returned by 'h' instead of blake2b. See NewTreeHasher. If the
+// hasher does not produce HashSize-byte digests, ErrHashWrongLen is returned.
+func ReaderMerkleRootHasher(r io.Reader, h func() hash.Hash) (Hash, error) {
+	hasher := h()
+	if hasher.Size() != HashSize {
+		return Hash{}, ErrHashWrongLen
+	}
+	t := NewTreeHasher(hasher)
+	if err := t.readAll(r); err != nil {
+		return Hash{}, err
+	}
+	return t.Root(), nil
+}
+
+// ReaderAtMerkleRoot returns the Merkle root of the first 'size' bytes of
+// 'r', reading each segment at its offset. The result is the same as calling
+// ReaderMerkleRoot on the same data. If 'r' holds fewer than 'size' bytes, the
+// error from ReadAt is returned.
+func ReaderAtMerkleRoot(r io.ReaderAt, size int64) (Hash, error) {
+	t := NewTree()
+	buf := make([]byte, SegmentSize)
+	for offset := int64(0); offset < size; offset += SegmentSize {
+		segment := buf
+		if size-offset < SegmentSize {
+			segment = buf[:size-offset]
+		}
+		n, err := r.ReadAt(segment, offset)
+		if err != nil && !(err == io.EOF && n == len(segment)) {
+			return Hash{}, err
+		}
+		t.Push(segment)
+	}
+	return t.Root(), nil
+}
+
+// ReaderMerkleRootParallel returns the Merkle root of the first 'size' bytes of
+// 'r', hashing independent subtrees of the data on 'workers' goroutines. If
+// 'workers' is less than 1, one worker per CPU is used. The result is
+// identical to ReaderMerkleRoot.
+func ReaderMerkleRootParallel(r io.ReaderAt, size int64, workers int) (Hash, error) {
+	if size <= 0 {
+		return Hash{}, nil
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	// Each chunk is hashed into its own stack. Every chunk except the final
+	// one is a complete, aligned subtree.
+	numChunks := (size + parallelChunkSize - 1) / parallelChunkSize
+	stacks := make([]subtreeStack, numChunks)
+	errs := make([]error, numChunks)
+	chunks := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, parallelChunkSize)
+			for chunk := range chunks {
+				offset := chunk * parallelChunkSize
+				data := buf
+				if size-offset < parallelChunkSize {
+					data = buf[:size-offset]
+				}
+				n, err := r.ReadAt(data, offset)
+				if err != nil && !(err == io.EOF && n == len(data)) {
+					errs[chunk] = err
+					continue
+				}
+				index := uint64(offset / SegmentSize)
+				b := bytes.NewBuffer(data)
+				for b.Len() > 0 {
+					stacks[chunk].push(subtree{index: index, sum: leafSum(b.Next(SegmentSize))})
+					index++
+				}
+			}
+		}()
+	}
+	for chunk := int64(0); chunk < numChunks; chunk++ {
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+
+	// Combine the chunks, in order, into the full tree.
+	var s subtreeStack
+	for i := range stacks {
+		if errs[i] != nil {
+			return Hash{}, errs[i]
+		}
+		for _, st := range stacks[i] {
+			s.push(st)
+		}
+	}
+	return s.root(), nil
+}
+
+// FileMerkleRoot returns the Merkle root of the file at 'path'. The file is
+// memory-mapped and hashed in place, releasing pages after they are hashed so
+// that memory usage stays roughly constant regardless of the size of the file.
+// If the file cannot be memory-mapped, it is streamed instead.
+func FileMerkleRoot(path string) (h Hash, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Hash{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return Hash{}, err
+	}
+	size := stat.Size()
+	if size == 0 || int64(int(size)) != size {
+		return ReaderMerkleRoot(f)
+	}
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		return ReaderMerkleRoot(f)
+	}
+	defer func() {
+		if unmapErr := munmapFile(data); unmapErr != nil && err == nil {
+			err = unmapErr
+		}
+	}()
+
+	// mmapChunkSize is a multiple of SegmentSize, so every segment falls
+	// within a single chunk.
+	t := NewTree()
+	for chunk := data; len(chunk) > 0; {
+		n := mmapChunkSize
+		if len(chunk) < n {
+			n = len(chunk)
+		}
+		buf := bytes.NewBuffer(chunk[:n])
+		for buf.Len() > 0 {
+			t.Push(buf.Next(SegmentSize))
+		}
+		releasePages(chunk[:n])
+		chunk = chunk[n:]
+	}
+	return t.Root(), nil
+}
+
 // MerkleProof builds a Merkle proof that the data at segment 'proofIndex' is a
 // part of the Merkle root formed by 'b'.
 func MerkleProof(b []byte, proofIndex uint64) (base []byte, hashSet []Hash) {
@@ -121,30 +1674,370 @@ func MerkleProof(b []byte, proofIndex uint64) (base []byte, hashSet []Hash) {
 	for buf.Len() > 0 {
 		t.Push(buf.Next(SegmentSize))
 	}
+	return t.ProveHashSet()
+}
 
-	// Get the proof and convert it to a base + hash set.
-	_, proof, _, _ := t.Prove()
-	if len(proof) == 0 {
-		// There's no proof, because there's no data. Return blank values.
-		return nil, nil
+// BuildReaderProof builds a Merkle proof that the segment at 'proofIndex' is a
+// part of the Merkle root formed by the data in 'r'. If 'r' runs out of data
+// before reaching 'proofIndex', ErrIndexOutOfRange is returned.
+//
+// The reader is streamed, and only the roots of unfinished subtrees and the
+// proof hashes found so far are kept, so at most a few hundred hashes are held
+// in memory no matter how large the data is. There is no need to spill
+// intermediate hashes to disk, even for data far larger than RAM.
+func BuildReaderProof(r io.Reader, proofIndex uint64) (base []byte, hashSet []Hash, err error) {
+	return BuildReaderProofSegSize(r, proofIndex, SegmentSize)
+}
+
+// BuildReaderProofSegSize is the same as BuildReaderProof, but uses leaves of
+// 'segmentSize' bytes.
+func BuildReaderProofSegSize(r io.Reader, proofIndex uint64, segmentSize int) (base []byte, hashSet []Hash, err error) {
+	if segmentSize <= 0 {
+		return nil, nil, ErrInvalidSegmentSize
+	}
+	t := NewTreeWithSegmentSize(segmentSize)
+	t.SetIndex(proofIndex)
+	if err := t.readAll(r); err != nil {
+		return nil, nil, err
+	}
+	base, hashSet = t.ProveHashSet()
+	if base == nil {
+		return nil, nil, ErrIndexOutOfRange
+	}
+	return base, hashSet, nil
+}
+
+// BuildReaderProofAtOffset builds a Merkle proof for the segment that holds
+// the byte at 'offset' of the data in 'r'. The index of that segment is
+// returned, along with the offset of the byte within the base segment; the
+// bytes from 'offset' to the end of the segment are base[segmentOffset:]. If
+// 'offset' lies past the end of the data, ErrIndexOutOfRange is returned.
+func BuildReaderProofAtOffset(r io.Reader, offset uint64) (base []byte, hashSet []Hash, index, segmentOffset uint64, err error) {
+	index, segmentOffset = offset/SegmentSize, offset%SegmentSize
+	base, hashSet, err = BuildReaderProof(r, index)
+	if err == ErrIndexOutOfRange || (err == nil && segmentOffset >= uint64(len(base))) {
+		return nil, nil, 0, 0, ErrIndexOutOfRange
+	} else if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return base, hashSet, index, segmentOffset, nil
+}
+
+// RootAndProof returns the Merkle root of the first 'size' bytes of 'r' along
+// with a proof for the segment at 'index', reading the data only once, in
+// large blocks. If 'index' is not a segment of the data, ErrIndexOutOfRange
+// is returned. If 'r' holds fewer than 'size' bytes, io.ErrUnexpectedEOF is
+// returned.
+func RootAndProof(r io.ReaderAt, size int64, index uint64) (root Hash, base []byte, hashSet []Hash, err error) {
+	if size <= 0 || index >= CalculateLeaves(uint64(size)) {
+		return Hash{}, nil, nil, ErrIndexOutOfRange
+	}
+	t := NewTree()
+	t.SetIndex(index)
+	if _, err := readSegmentsAt(r, size, t.Push); err != nil {
+		return Hash{}, nil, nil, err
+	}
+	base, hashSet = t.ProveHashSet()
+	return t.Root(), base, hashSet, nil
+}
+
+// proofShape returns the shape of a proof for leaf 'index' of a tree with
+// 'numLeaves' leaves: the height of the perfect subtree containing the leaf,
+// whether any leaves lie to the right of that subtree, and the number of
+// subtrees to its left. 'index' must be less than 'numLeaves'.
+func proofShape(numLeaves, index uint64) (height uint64, right bool, left int) {
+	// The tree is made of one perfect subtree for every bit set in numLeaves,
+	// largest first.
+	var start uint64
+	for height = 63; ; height-- {
+		if numLeaves&(1<<height) == 0 {
+			continue
+		}
+		if index-start < 1<<height {
+			return height, start+1<<height < numLeaves, left
+		}
+		start += 1 << height
+		left++
+	}
+}
+
+// BuildAndVerify builds a proof for the segment at 'index' of 'data' and
+// verifies it against the Merkle root of 'data', exercising the whole proof
+// pipeline. It is intended as an entry point for randomized testing. If
+// 'index' is not a leaf of 'data', ErrIndexOutOfRange is returned.
+func BuildAndVerify(data []byte, index uint64) (bool, error) {
+	numLeaves := CalculateLeaves(uint64(len(data)))
+	if len(data) == 0 || index >= numLeaves {
+		return false, ErrIndexOutOfRange
+	}
+	base, hashSet, err := BuildReaderProof(bytes.NewReader(data), index)
+	if err != nil {
+		return false, err
+	}
+	return VerifySegmentSegSize(base, hashSet, numLeaves, index, MerkleRoot(data), SegmentSize), nil
+}
+
+// ProofSize returns the number of hashes in the hash set that BuildReaderProof
+// returns for the leaf at 'index' of a tree with 'numLeaves' leaves. If
+// 'index' is not less than 'numLeaves', no proof can be built and 0 is
+// returned.
+func ProofSize(numLeaves, index uint64) int {
+	if index >= numLeaves {
+		return 0
 	}
+	height, right, left := proofShape(numLeaves, index)
+	size := int(height) + left
+	if right {
+		size++
+	}
+	return size
+}
 
-	base = proof[0]
-	hashSet = make([]Hash, len(proof)-1)
-	for i, p := range proof[1:] {
-		copy(hashSet[i][:], p)
+// ProofPath returns, for each hash in the proof of the leaf at 'index' of a
+// tree with 'numLeaves' leaves, whether that hash is the left child of its
+// parent, and so is hashed before the node built from the segment. The path
+// has ProofSize(numLeaves, index) entries, in the same order as the hash set.
+func ProofPath(numLeaves, index uint64) []bool {
+	path := make([]bool, ProofSize(numLeaves, index))
+	if len(path) == 0 {
+		return path
 	}
-	return base, hashSet
+	height, right, _ := proofShape(numLeaves, index)
+	for i := range path {
+		if i := uint64(i); i < height {
+			path[i] = (index>>i)&1 == 1
+		} else {
+			path[i] = i != height || !right
+		}
+	}
+	return path
+}
+
+// ProofParams describes the hashes that make up a proof, so that proofs built
+// with a hash other than blake2b-256, including hashes that are not HashSize
+// bytes, can be checked. Proofs built by this package always use blake2b-256;
+// see DefaultProofParams.
+type ProofParams struct {
+	// HashLen is the size of each hash in the proof, in bytes.
+	HashLen int
+
+	// NewHasher returns the hash used for the leaves and nodes of the tree,
+	// which must produce HashLen-byte digests. If it is nil, blake2b-256 is
+	// used.
+	NewHasher func() hash.Hash
+}
+
+// DefaultProofParams are the parameters of the proofs built by this package.
+var DefaultProofParams = ProofParams{HashLen: HashSize, NewHasher: NewHash}
+
+// ValidateProofShape checks that an externally supplied hash set has the
+// shape of a proof for the leaf at 'index' of a tree with 'numLeaves' leaves,
+// without checking it against a root. It returns ErrIndexOutOfRange if there
+// is no such leaf, ErrProofWrongLength if the number of hashes is wrong, and
+// ErrHashWrongLen if any hash is not HashSize bytes.
+func ValidateProofShape(hashSet [][]byte, numLeaves, index uint64) error {
+	return DefaultProofParams.ValidateProofShape(hashSet, numLeaves, index)
+}
+
+// ValidateProofShape is the same as the ValidateProofShape function, but
+// checks that each hash is p.HashLen bytes.
+func (p ProofParams) ValidateProofShape(hashSet [][]byte, numLeaves, index uint64) error {
+	if index >= numLeaves {
+		return ErrIndexOutOfRange
+	} else if len(hashSet) != ProofSize(numLeaves, index) {
+		return ErrProofWrongLength
+	}
+	for _, h := range hashSet {
+		if len(h) != p.HashLen {
+			return ErrHashWrongLen
+		}
+	}
+	return nil
+}
+
+// VerifySegment verifies a proof whose hashes are p.HashLen bytes, built with
+// the hash returned by p.NewHasher. The leaves and nodes of the tree are
+// prefixed with LeafHashPrefix and NodeHashPrefix, as they are for blake2b.
+// An error is returned if the proof or the root does not have the right shape
+// for p, as described by ValidateProofShape; a well-formed proof that does
+// not match 'root' returns false.
+func (p ProofParams) VerifySegment(base []byte, hashSet [][]byte, numLeaves, index uint64, root []byte) (bool, error) {
+	if err := p.ValidateProofShape(hashSet, numLeaves, index); err != nil {
+		return false, err
+	} else if len(root) != p.HashLen {
+		return false, ErrHashWrongLen
+	}
+	newHasher := p.NewHasher
+	if newHasher == nil {
+		newHasher = NewHash
+	}
+	h := newHasher()
+	if h.Size() != p.HashLen {
+		return false, ErrHashWrongLen
+	}
+
+	h.Write(leafHashPrefix)
+	h.Write(base)
+	sum := h.Sum(nil)
+	for i, left := range ProofPath(numLeaves, index) {
+		h.Reset()
+		h.Write(nodeHashPrefix)
+		if left {
+			h.Write(hashSet[i])
+			h.Write(sum)
+		} else {
+			h.Write(sum)
+			h.Write(hashSet[i])
+		}
+		sum = h.Sum(sum[:0])
+	}
+	return subtle.ConstantTimeCompare(sum, root) == 1, nil
+}
+
+// VerifySegmentErr verifies that a segment, given the proof, is a part of a
+// Merkle root. The error describes why verification failed, and is nil if the
+// proof is valid.
+func VerifySegmentErr(base []byte, hashSet []Hash, numSegments, proofIndex uint64, root Hash) error {
+	pv := NewProofVerifier(numSegments, proofIndex, root)
+	if err := pv.WriteSegment(base); err != nil {
+		return err
+	}
+	for _, h := range hashSet {
+		if err := pv.WriteProofHash(h); err != nil {
+			return err
+		}
+	}
+	return pv.verifyErr()
 }
 
 // VerifySegment will verify that a segment, given the proof, is a part of a
 // Merkle root.
+//
+// The final leaf of a tree is never padded, so a short final segment is passed
+// exactly as it appears in the data, and padding it would make the proof fail.
+// VerifySegment does not check the length of 'base', because it also verifies
+// proofs whose leaves are not segments, such as those built by FoldRoots; use
+// VerifySegmentSegSize or VerifySegmentWithOpts to reject short segments at
+// non-final indices.
 func VerifySegment(base []byte, hashSet []Hash, numSegments, proofIndex uint64, root Hash) bool {
-	// convert base and hashSet to proofSet
-	proofSet := make([][]byte, len(hashSet)+1)
-	proofSet[0] = base
-	for i := range hashSet {
-		proofSet[i+1] = hashSet[i][:]
+	return VerifySegmentErr(base, hashSet, numSegments, proofIndex, root) == nil
+}
+
+// VerifySegmentFlat is the same as VerifySegment, but takes the hash set as
+// the concatenation of its hashes. An error is returned if 'flatHashes' is not
+// a whole number of hashes, or does not hold the number of hashes the proof
+// requires; a well-formed proof that does not match 'root' returns false.
+func VerifySegmentFlat(base []byte, flatHashes []byte, numLeaves, index uint64, root Hash) (bool, error) {
+	if len(flatHashes)%HashSize != 0 {
+		return false, ErrHashWrongLen
+	} else if index >= numLeaves {
+		return false, ErrIndexOutOfRange
+	} else if len(flatHashes)/HashSize != ProofSize(numLeaves, index) {
+		return false, ErrProofWrongLength
+	}
+	pv := NewProofVerifier(numLeaves, index, root)
+	pv.WriteSegment(base)
+	for len(flatHashes) > 0 {
+		var h Hash
+		copy(h[:], flatHashes)
+		pv.WriteProofHash(h)
+		flatHashes = flatHashes[HashSize:]
+	}
+	return pv.Verify(), nil
+}
+
+// VerifySegmentSegSize verifies a proof built with leaves of 'segmentSize'
+// bytes. Unlike VerifySegment, it also checks that the base segment has the
+// right length: only the final segment may be shorter than 'segmentSize'.
+func VerifySegmentSegSize(base []byte, hashSet []Hash, numSegments, proofIndex uint64, root Hash, segmentSize int) bool {
+	if len(base) > segmentSize || (len(base) < segmentSize && proofIndex != numSegments-1) {
+		return false
+	}
+	return VerifySegment(base, hashSet, numSegments, proofIndex, root)
+}
+
+// VerifySegmentOpts holds optional parameters for VerifySegmentWithOpts.
+type VerifySegmentOpts struct {
+	// LastLeafSize is the exact size of the final leaf of the tree, between 1
+	// and SegmentSize. If it is zero, the final leaf may be any size up to
+	// SegmentSize.
+	LastLeafSize uint64
+}
+
+// VerifySegmentWithOpts is the same as VerifySegment, but also checks the size
+// of 'base'. Leaves are never padded, so 'base' must be exactly SegmentSize
+// bytes unless 'proofIndex' is the final leaf, in which case it must be
+// opts.LastLeafSize bytes.
+func VerifySegmentWithOpts(base []byte, hashSet []Hash, numSegments, proofIndex uint64, root Hash, opts VerifySegmentOpts) bool {
+	if opts.LastLeafSize > SegmentSize {
+		return false
+	}
+	if opts.LastLeafSize != 0 && proofIndex == numSegments-1 && uint64(len(base)) != opts.LastLeafSize {
+		return false
+	}
+	return VerifySegmentSegSize(base, hashSet, numSegments, proofIndex, root, SegmentSize)
+}
+
+// VerifySegmentBySize is the same as VerifySegment, but takes the size of the
+// data in bytes instead of the number of leaves. Because the size of the final
+// leaf is known, its base segment must be exactly that size.
+func VerifySegmentBySize(base []byte, hashSet []Hash, totalSize, index uint64, root Hash) bool {
+	if totalSize == 0 {
+		return false
 	}
-	return merkletree.VerifyProof(NewHash(), root[:], proofSet, proofIndex, numSegments)
+	numLeaves := CalculateLeaves(totalSize)
+	opts := VerifySegmentOpts{
+		LastLeafSize: totalSize - (numLeaves-1)*SegmentSize,
+	}
+	return VerifySegmentWithOpts(base, hashSet, numLeaves, index, root, opts)
+}
+
+// VerifyWithSize is the same as VerifySegmentBySize, but returns
+// ErrIndexOutOfRange if 'index' is not a leaf of data of 'claimedSize' bytes,
+// so that a proof for a leaf past the end of the claimed data is reported
+// rather than just failing. Empty data has no leaves that can be proven.
+func VerifyWithSize(base []byte, hashSet []Hash, claimedSize, index uint64, root Hash) (bool, error) {
+	if claimedSize == 0 || index >= CalculateLeaves(claimedSize) {
+		return false, ErrIndexOutOfRange
+	}
+	return VerifySegmentBySize(base, hashSet, claimedSize, index, root), nil
+}
+
+// VerifySegmentHex is the same as VerifySegment, but takes the Merkle root as
+// a hex string. An error is returned if the string is not exactly HashSize*2
+// hex characters.
+func VerifySegmentHex(base []byte, hashSet []Hash, numLeaves, index uint64, rootHex string) (bool, error) {
+	var root Hash
+	if err := root.LoadString(rootHex); err != nil {
+		return false, err
+	}
+	return VerifySegment(base, hashSet, numLeaves, index, root), nil
+}
+
+// VerifySegmentData verifies that 'expectedData' is the segment at 'index' of
+// the Merkle tree with root 'root'. It is intended for checking a proof against
+// the data the caller expected to find at that index, rather than the base
+// segment returned by BuildReaderProof. Leaves are not padded, so
+// 'expectedData' must be exactly SegmentSize bytes unless 'index' is the final
+// leaf, in which case it must be the unpadded contents of that leaf.
+func VerifySegmentData(expectedData []byte, hashSet []Hash, numLeaves, index uint64, root Hash) bool {
+	return VerifySegmentSegSize(expectedData, hashSet, numLeaves, index, root, SegmentSize)
+}
+
+// BuildDiffProof builds a proof that can be used with VerifyDiffProof to show
+// that only the segment at 'index' of the data in 'r' is changed by an update.
+// A diff proof is an ordinary storage proof for the old segment: the sibling
+// hashes are shared by the old and new trees because every other leaf is
+// untouched.
+func BuildDiffProof(r io.Reader, index uint64) (oldSegment []byte, hashSet []Hash, err error) {
+	return BuildReaderProof(r, index)
+}
+
+// VerifyDiffProof verifies that replacing the segment at 'index' of the tree
+// with root 'oldRoot' with 'newSegment' produces the tree with root 'newRoot',
+// and that no other leaf was changed. Both segments must be SegmentSize bytes
+// unless 'index' is the final leaf.
+func VerifyDiffProof(oldSegment, newSegment []byte, hashSet []Hash, numLeaves, index uint64, oldRoot, newRoot Hash) bool {
+	return VerifySegmentSegSize(oldSegment, hashSet, numLeaves, index, oldRoot, SegmentSize) &&
+		VerifySegmentSegSize(newSegment, hashSet, numLeaves, index, newRoot, SegmentSize)
 }
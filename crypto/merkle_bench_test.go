@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/fastrand"
+)
+
+// BenchmarkReaderMerkleRoot benchmarks the sequential Merkle root of a 4 MiB
+// sector.
+func BenchmarkReaderMerkleRoot(b *testing.B) {
+	data := fastrand.Bytes(1 << 22)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ReaderMerkleRoot(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReaderMerkleRootParallel benchmarks the parallel Merkle root of a 4
+// MiB sector, using one worker per CPU.
+func BenchmarkReaderMerkleRootParallel(b *testing.B) {
+	data := fastrand.Bytes(1 << 22)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ReaderMerkleRootParallel(bytes.NewReader(data), int64(len(data)), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkFileRoot benchmarks computing the Merkle root of a 4 MiB file with
+// 'root'.
+func benchmarkFileRoot(b *testing.B, root func(io.Reader) (Hash, error)) {
+	dir := build.TempDir("crypto", b.Name())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		b.Fatal(err)
+	}
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, fastrand.Bytes(1<<22), 0600); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	b.SetBytes(1 << 22)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := root(f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReaderMerkleRootFile benchmarks ReaderMerkleRoot reading directly
+// from a file.
+func BenchmarkReaderMerkleRootFile(b *testing.B) {
+	benchmarkFileRoot(b, ReaderMerkleRoot)
+}
+
+// BenchmarkBufferedReaderMerkleRootFile benchmarks BufferedReaderMerkleRoot
+// reading directly from a file.
+func BenchmarkBufferedReaderMerkleRootFile(b *testing.B) {
+	benchmarkFileRoot(b, BufferedReaderMerkleRoot)
+}
+
+// BenchmarkSectorRooter benchmarks computing the Merkle roots of a stream of 4
+// MiB sectors with a single SectorRooter.
+func BenchmarkSectorRooter(b *testing.B) {
+	data := fastrand.Bytes(1 << 22)
+	sr := NewSectorRooter(len(data))
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sr.RootOf(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
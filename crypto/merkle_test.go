@@ -1,9 +1,22 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/NebulousLabs/Sia/build"
+	"github.com/NebulousLabs/Sia/encoding"
 	"github.com/NebulousLabs/fastrand"
+	"github.com/NebulousLabs/merkletree"
 )
 
 // TestTreeBuilder builds a tree and gets the merkle root.
@@ -17,6 +30,409 @@ func TestTreeBuilder(t *testing.T) {
 	// function is really for code coverage.
 }
 
+// TestTreeMatchesMerkletree checks that the roots and proofs produced by
+// MerkleTree are identical to those produced by merkletree.Tree.
+func TestTreeMatchesMerkletree(t *testing.T) {
+	for numLeaves := uint64(0); numLeaves < 40; numLeaves++ {
+		leaves := make([][]byte, numLeaves)
+		for i := range leaves {
+			leaves[i] = fastrand.Bytes(SegmentSize)
+		}
+		for proofIndex := uint64(0); proofIndex <= numLeaves; proofIndex++ {
+			tree := NewTree()
+			tree.SetIndex(proofIndex)
+			mt := merkletree.New(NewHash())
+			mt.SetIndex(proofIndex)
+			for _, leaf := range leaves {
+				tree.Push(leaf)
+				mt.Push(leaf)
+			}
+			mtRoot, mtProof, mtIndex, mtLeaves := mt.Prove()
+			if root := tree.Root(); !bytes.Equal(root[:], mtRoot) && numLeaves != 0 {
+				t.Fatal("root does not match merkletree for", numLeaves, "leaves")
+			}
+
+			// Prove should return exactly what merkletree.Tree.Prove does.
+			root, proofSet, index, pushed := tree.Prove()
+			if !bytes.Equal(root, mtRoot) || index != mtIndex || pushed != mtLeaves || len(proofSet) != len(mtProof) {
+				t.Fatal("Prove does not match merkletree for index", proofIndex, "of", numLeaves)
+			}
+			for i := range proofSet {
+				if !bytes.Equal(proofSet[i], mtProof[i]) {
+					t.Fatal("Prove does not match merkletree for index", proofIndex, "of", numLeaves)
+				}
+			}
+			base, hashSet := tree.ProveHashSet()
+			if len(mtProof) == 0 {
+				if base != nil || hashSet != nil {
+					t.Fatal("expected no proof for index", proofIndex, "of", numLeaves)
+				}
+				continue
+			}
+			if !bytes.Equal(base, mtProof[0]) || len(hashSet) != len(mtProof)-1 {
+				t.Fatal("proof does not match merkletree for index", proofIndex, "of", numLeaves)
+			}
+			for i := range hashSet {
+				if !bytes.Equal(hashSet[i][:], mtProof[i+1]) {
+					t.Fatal("proof does not match merkletree for index", proofIndex, "of", numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// TestTreeMatchesMerkletreeRandom checks that the roots and proofs produced
+// for data of random sizes, including a short final segment, are identical to
+// those produced by merkletree.Tree.
+func TestTreeMatchesMerkletreeRandom(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		data := fastrand.Bytes(fastrand.Intn(SegmentSize * 300))
+		mt := merkletree.New(NewHash())
+		if err := mt.ReadAll(bytes.NewReader(data), SegmentSize); err != nil {
+			t.Fatal(err)
+		}
+		root := MerkleRoot(data)
+		if mtRoot := mt.Root(); !bytes.Equal(root[:], mtRoot) && len(data) != 0 {
+			t.Fatal("root does not match merkletree for", len(data), "bytes")
+		}
+		tree := NewTree()
+		if err := tree.ReadAll(bytes.NewReader(data), SegmentSize); err != nil {
+			t.Fatal(err)
+		} else if tree.Root() != root {
+			t.Fatal("ReadAll produced the wrong root for", len(data), "bytes")
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		numLeaves := CalculateLeaves(uint64(len(data)))
+		for _, index := range []uint64{0, fastrand.Uint64n(numLeaves), numLeaves - 1} {
+			mt := merkletree.New(NewHash())
+			mt.SetIndex(index)
+			mt.ReadAll(bytes.NewReader(data), SegmentSize)
+			_, mtProof, _, _ := mt.Prove()
+			base, hashSet := MerkleProof(data, index)
+			if !bytes.Equal(base, mtProof[0]) || len(hashSet) != len(mtProof)-1 {
+				t.Fatal("proof does not match merkletree for index", index, "of", numLeaves)
+			}
+			for j := range hashSet {
+				if !bytes.Equal(hashSet[j][:], mtProof[j+1]) {
+					t.Fatal("proof does not match merkletree for index", index, "of", numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// TestTreeState checks that a tree can be marshalled partway through being
+// built and resumed later.
+func TestTreeState(t *testing.T) {
+	for numLeaves := 0; numLeaves < 20; numLeaves++ {
+		full := NewTree()
+		partial := NewTree()
+		for i := 0; i < numLeaves; i++ {
+			full.PushObject(i)
+			partial.PushObject(i)
+		}
+		state, err := partial.MarshalState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed, err := UnmarshalTreeState(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := numLeaves; i < numLeaves+13; i++ {
+			full.PushObject(i)
+			resumed.PushObject(i)
+		}
+		if resumed.Root() != full.Root() {
+			t.Fatal("resumed tree has the wrong root after", numLeaves, "leaves")
+		}
+	}
+
+	// A corrupt state should be rejected.
+	tree := NewTree()
+	tree.PushObject("a")
+	tree.PushObject("b")
+	tree.PushObject("c")
+	state, _ := tree.MarshalState()
+	for _, size := range []uint64{0, 1<<22 + 1, 1 << 40, 1 << 63, ^uint64(0)} {
+		corrupt := encoding.Marshal(merkleTreeState{NumLeaves: 1, SegmentSize: size, Subtrees: []Hash{{}}})
+		if _, err := UnmarshalTreeState(corrupt); err != ErrInvalidSegmentSize {
+			t.Error("expected ErrInvalidSegmentSize for segment size", size, "got", err)
+		}
+		if _, err := ExtendRoot(corrupt, bytes.NewReader(nil)); err != ErrInvalidSegmentSize {
+			t.Error("expected ErrInvalidSegmentSize from ExtendRoot for segment size", size, "got", err)
+		}
+	}
+	if _, err := UnmarshalTreeState(state[:len(state)-HashSize]); err == nil {
+		t.Error("expected an error when unmarshalling a truncated state")
+	}
+
+	// A tree that is building a proof cannot be marshalled.
+	tree = NewTree()
+	tree.SetIndex(0)
+	if _, err := tree.MarshalState(); err != errProofTreeState {
+		t.Error("expected errProofTreeState, got", err)
+	}
+}
+
+// TestPartialRoot checks that the root can be queried while a tree is being
+// built without disturbing it.
+func TestPartialRoot(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*11 + 7)
+	tree := NewTree()
+	tree.SetIndex(4)
+	buf := bytes.NewBuffer(data)
+	for pushed := SegmentSize; buf.Len() > 0; pushed += SegmentSize {
+		tree.Push(buf.Next(SegmentSize))
+		if pushed > len(data) {
+			pushed = len(data)
+		}
+		if tree.Root() != MerkleRoot(data[:pushed]) {
+			t.Fatal("wrong partial root after", pushed, "bytes")
+		}
+	}
+	base, hashSet := tree.ProveHashSet()
+	if !VerifySegment(base, hashSet, 12, 4, MerkleRoot(data)) {
+		t.Fatal("proof did not verify after querying partial roots")
+	}
+}
+
+// TestPushReader checks that reader pushes can be mixed with other pushes.
+func TestPushReader(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*10 + 5)
+	tree := NewTree()
+	tree.Push(data[:SegmentSize])
+	n, err := tree.PushReader(bytes.NewReader(data[SegmentSize : SegmentSize*7]))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != SegmentSize*6 {
+		t.Fatal("wrong number of bytes read:", n)
+	}
+	n, err = tree.PushReader(bytes.NewReader(data[SegmentSize*7:]))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != SegmentSize*3+5 {
+		t.Fatal("wrong number of bytes read:", n)
+	}
+	if tree.Root() != MerkleRoot(data) {
+		t.Fatal("PushReader produced the wrong root")
+	}
+
+	// A bounded tree stops reading once it is full.
+	bounded := NewBoundedTree(2)
+	r := bytes.NewReader(data)
+	n, err = bounded.PushReader(r)
+	if err != ErrTreeTooLarge {
+		t.Fatal("expected ErrTreeTooLarge, got", err)
+	} else if n != SegmentSize*4 {
+		t.Fatal("wrong number of bytes pushed:", n)
+	} else if bounded.Root() != MerkleRoot(data[:SegmentSize*4]) {
+		t.Fatal("bounded tree has the wrong root")
+	} else if r.Len() != len(data)-SegmentSize*5 {
+		t.Fatal("bounded tree kept reading after it was full")
+	}
+}
+
+// TestTreeReset checks that a reset tree behaves like a new one.
+func TestTreeReset(t *testing.T) {
+	tree := NewTree()
+	tree.SetIndex(3)
+	for i := 0; i < 11; i++ {
+		tree.PushObject(i)
+	}
+	for numLeaves := 0; numLeaves < 20; numLeaves++ {
+		tree.Reset()
+		fresh := NewTree()
+		for i := 0; i < numLeaves; i++ {
+			tree.PushObject(i * 7)
+			fresh.PushObject(i * 7)
+		}
+		if tree.Root() != fresh.Root() {
+			t.Fatal("reset tree has the wrong root after", numLeaves, "leaves")
+		}
+	}
+
+	// A reset tree can build a new proof.
+	tree.Reset()
+	if err := tree.SetIndex(2); err != nil {
+		t.Fatal(err)
+	}
+	data := fastrand.Bytes(SegmentSize*5 + 3)
+	buf := bytes.NewBuffer(data)
+	for buf.Len() > 0 {
+		tree.Push(buf.Next(SegmentSize))
+	}
+	base, hashSet := tree.ProveHashSet()
+	if !VerifySegment(base, hashSet, 6, 2, MerkleRoot(data)) {
+		t.Fatal("proof from a reset tree did not verify")
+	}
+}
+
+// TestTreeClone checks that pushing to a clone of a tree does not affect the
+// original.
+func TestTreeClone(t *testing.T) {
+	tree := NewTree()
+	tree.SetIndex(4)
+	for i := 0; i < 7; i++ {
+		tree.PushObject(i)
+	}
+	root := tree.Root()
+	clone := tree.Clone()
+	if clone.Root() != root {
+		t.Fatal("clone has a different root")
+	}
+	clone.PushObject(7)
+	clone.PushObject(8)
+	if tree.Root() != root {
+		t.Fatal("pushing to the clone changed the original's root")
+	}
+
+	// Both trees should continue to build correct proofs.
+	expected := NewTree()
+	for i := 0; i < 9; i++ {
+		expected.PushObject(i)
+	}
+	base, hashSet := clone.ProveHashSet()
+	if clone.Root() != expected.Root() || !VerifySegment(base, hashSet, 9, 4, expected.Root()) {
+		t.Fatal("clone built the wrong proof")
+	}
+	tree.PushObject(100)
+	base, hashSet = tree.ProveHashSet()
+	if !VerifySegment(base, hashSet, 8, 4, tree.Root()) {
+		t.Fatal("original built the wrong proof after cloning")
+	}
+}
+
+// TestBoundedTree checks that a bounded tree refuses to grow past its maximum
+// height.
+func TestBoundedTree(t *testing.T) {
+	tree := NewBoundedTree(3)
+	for i := 0; i < 8; i++ {
+		if err := tree.PushObject(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.PushObject(8); err != ErrTreeTooLarge {
+		t.Fatal("expected ErrTreeTooLarge, got", err)
+	}
+	if err := tree.PushSegment(nil); err != ErrTreeTooLarge {
+		t.Fatal("expected ErrTreeTooLarge, got", err)
+	}
+	full := NewTree()
+	for i := 0; i < 8; i++ {
+		full.PushObject(i)
+	}
+	if tree.Root() != full.Root() {
+		t.Fatal("bounded tree has the wrong root")
+	}
+
+	// A tree of height 0 holds a single leaf.
+	tree = NewBoundedTree(0)
+	if err := tree.PushObject(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.PushEncoded(rawMarshaler("a")); err != ErrTreeTooLarge {
+		t.Fatal("expected ErrTreeTooLarge, got", err)
+	}
+}
+
+// TestExtendRoot checks that extending a root with appended data matches
+// recomputing the root from scratch.
+func TestExtendRoot(t *testing.T) {
+	for _, numSegments := range []int{0, 1, 5, 8} {
+		existing := fastrand.Bytes(SegmentSize * numSegments)
+		appended := fastrand.Bytes(SegmentSize*3 + 11)
+		tree := NewTree()
+		buf := bytes.NewBuffer(existing)
+		for buf.Len() > 0 {
+			tree.Push(buf.Next(SegmentSize))
+		}
+		state, err := tree.MarshalState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := ExtendRoot(state, bytes.NewReader(appended))
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(append(existing, appended...)) {
+			t.Fatal("extended root does not match the full root after", numSegments, "segments")
+		}
+	}
+	if _, err := ExtendRoot(nil, bytes.NewReader(nil)); err == nil {
+		t.Error("expected an error for an empty state")
+	}
+}
+
+// TestMergeTrees checks that two trees can be merged when the first ends on
+// a subtree boundary of the second.
+func TestMergeTrees(t *testing.T) {
+	for _, sizes := range [][2]int{{0, 5}, {4, 3}, {8, 8}, {8, 13}, {5, 1}, {12, 4}, {16, 0}} {
+		a, b, full := NewTree(), NewTree(), NewTree()
+		for i := 0; i < sizes[0]; i++ {
+			a.PushObject(i)
+			full.PushObject(i)
+		}
+		for i := sizes[0]; i < sizes[0]+sizes[1]; i++ {
+			b.PushObject(i)
+			full.PushObject(i)
+		}
+		merged, err := MergeTrees(a, b)
+		if err != nil {
+			t.Fatal(err)
+		} else if merged.Root() != full.Root() {
+			t.Fatal("wrong root after merging", sizes)
+		}
+
+		// The merged tree should keep growing correctly.
+		merged.PushObject("x")
+		full.PushObject("x")
+		if merged.Root() != full.Root() {
+			t.Fatal("wrong root after pushing onto merged tree", sizes)
+		}
+	}
+
+	// 3 leaves followed by a subtree of 2 leaves cannot be joined.
+	a, b := NewTree(), NewTree()
+	for i := 0; i < 3; i++ {
+		a.PushObject(i)
+	}
+	b.PushObject(3)
+	b.PushObject(4)
+	if _, err := MergeTrees(a, b); err != errUnalignedMerge {
+		t.Error("expected errUnalignedMerge, got", err)
+	}
+	if _, err := MergeTrees(a, NewTree()); err != nil {
+		t.Error(err)
+	}
+	p := NewTree()
+	p.SetIndex(0)
+	if _, err := MergeTrees(a, p); err != errIncompatibleMerge {
+		t.Error("expected errIncompatibleMerge, got", err)
+	}
+}
+
+// TestPushSegment checks that PushSegment matches Push, and rejects segments
+// that are too large.
+func TestPushSegment(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*3 + 1)
+	tree := NewTree()
+	buf := bytes.NewBuffer(data)
+	for buf.Len() > 0 {
+		if err := tree.PushSegment(buf.Next(SegmentSize)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tree.Root() != MerkleRoot(data) {
+		t.Fatal("PushSegment does not match MerkleRoot")
+	}
+	if err := tree.PushSegment(make([]byte, SegmentSize+1)); err != ErrSegmentTooLarge {
+		t.Fatal("expected ErrSegmentTooLarge, got", err)
+	}
+}
+
 // TestCalculateLeaves probes the CalculateLeaves function.
 func TestCalculateLeaves(t *testing.T) {
 	tests := []struct {
@@ -38,6 +454,71 @@ func TestCalculateLeaves(t *testing.T) {
 	}
 }
 
+// TestTreeHeight probes the TreeHeight function.
+func TestTreeHeight(t *testing.T) {
+	tests := []struct {
+		numLeaves, height uint64
+	}{
+		{0, 0}, {1, 0}, {2, 1}, {3, 2}, {4, 2}, {5, 3}, {8, 3}, {9, 4},
+		{1 << 16, 16}, {1<<16 + 1, 17}, {1 << 63, 63}, {1<<63 + 1, 64}, {^uint64(0), 64},
+	}
+	for _, test := range tests {
+		if h := TreeHeight(test.numLeaves); h != test.height {
+			t.Errorf("TreeHeight(%v) = %v, expected %v", test.numLeaves, h, test.height)
+		}
+	}
+}
+
+// TestBytesForLeaves probes the BytesForLeaves and LeafRange functions.
+func TestBytesForLeaves(t *testing.T) {
+	tests := []struct {
+		leaves, expBytes uint64
+	}{
+		{0, 0},
+		{1, 64},
+		{2, 128},
+		{3, 192},
+	}
+	for i, test := range tests {
+		if b := BytesForLeaves(test.leaves); b != test.expBytes {
+			t.Errorf("miscalculation for test %v: expected %v, got %v", i, test.expBytes, b)
+		}
+		if CalculateLeaves(test.expBytes) != test.leaves && test.leaves != 0 {
+			t.Errorf("BytesForLeaves is not the inverse of CalculateLeaves for test %v", i)
+		}
+	}
+
+	if start, end := LeafRange(0); start != 0 || end != 64 {
+		t.Error("wrong range for leaf 0:", start, end)
+	}
+	if start, end := LeafRange(5); start != 320 || end != 384 {
+		t.Error("wrong range for leaf 5:", start, end)
+	}
+}
+
+// TestLastLeaf checks IsLastLeaf and LastLeafSize against the proofs built for
+// files of several sizes.
+func TestLastLeaf(t *testing.T) {
+	for _, size := range []uint64{0, 1, 63, 64, 65, 200, 256} {
+		numLeaves := CalculateLeaves(size)
+		data := fastrand.Bytes(int(size))
+		for index := uint64(0); index < numLeaves; index++ {
+			base, _ := MerkleProof(data, index)
+			if IsLastLeaf(numLeaves, index) && uint64(len(base)) != LastLeafSize(size) {
+				t.Errorf("final leaf of %v bytes has %v bytes, LastLeafSize returned %v", size, len(base), LastLeafSize(size))
+			} else if !IsLastLeaf(numLeaves, index) && len(base) != SegmentSize {
+				t.Errorf("leaf %v of %v bytes is short but is not the final leaf", index, size)
+			}
+		}
+		if IsLastLeaf(numLeaves, numLeaves) {
+			t.Error("IsLastLeaf accepted an index past the end of the tree")
+		}
+	}
+	if IsLastLeaf(0, 0) {
+		t.Error("IsLastLeaf accepted a tree with no leaves")
+	}
+}
+
 // TestStorageProof builds a storage proof and checks that it verifies
 // correctly.
 func TestStorageProof(t *testing.T) {
@@ -75,6 +556,76 @@ func TestNonMultipleLeafSizeStorageProof(t *testing.T) {
 	}
 }
 
+// TestVerifySegmentWithOpts checks that the size of the final leaf can be
+// stated explicitly.
+func TestVerifySegmentWithOpts(t *testing.T) {
+	data := fastrand.Bytes((2 * SegmentSize) + 10)
+	rootHash := MerkleRoot(data)
+
+	baseSegment, hashSet := MerkleProof(data, 2)
+	if !VerifySegmentWithOpts(baseSegment, hashSet, 3, 2, rootHash, VerifySegmentOpts{LastLeafSize: 10}) {
+		t.Error("proof with the correct final leaf size failed")
+	}
+	if !VerifySegmentWithOpts(baseSegment, hashSet, 3, 2, rootHash, VerifySegmentOpts{}) {
+		t.Error("proof without a final leaf size failed")
+	}
+	if VerifySegmentWithOpts(baseSegment, hashSet, 3, 2, rootHash, VerifySegmentOpts{LastLeafSize: 11}) {
+		t.Error("proof with the wrong final leaf size succeeded")
+	}
+	padded := append(append([]byte(nil), baseSegment...), make([]byte, SegmentSize-10)...)
+	if VerifySegmentWithOpts(padded, hashSet, 3, 2, rootHash, VerifySegmentOpts{LastLeafSize: 10}) {
+		t.Error("padded final leaf succeeded")
+	}
+
+	// The final leaf size does not apply to other leaves.
+	baseSegment, hashSet = MerkleProof(data, 1)
+	if !VerifySegmentWithOpts(baseSegment, hashSet, 3, 1, rootHash, VerifySegmentOpts{LastLeafSize: 10}) {
+		t.Error("proof for a full leaf failed")
+	}
+}
+
+// TestVerifySegmentBySize checks that proofs can be verified using the size
+// of the data instead of the number of leaves.
+func TestVerifySegmentBySize(t *testing.T) {
+	for _, size := range []int{1, SegmentSize, SegmentSize*4 + 1, SegmentSize * 6} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		numLeaves := CalculateLeaves(uint64(size))
+		for index := uint64(0); index < numLeaves; index++ {
+			base, hashSet := MerkleProof(data, index)
+			if !VerifySegmentBySize(base, hashSet, uint64(size), index, root) {
+				t.Fatalf("proof for index %v of %v bytes did not verify", index, size)
+			}
+		}
+
+		// The final leaf must match the size of the data.
+		base, hashSet := MerkleProof(data, numLeaves-1)
+		if size%SegmentSize != 0 && VerifySegmentBySize(base, hashSet, uint64(size)+1, numLeaves-1, root) {
+			t.Fatalf("proof for the final leaf of %v bytes verified with the wrong size", size)
+		}
+	}
+	if VerifySegmentBySize(nil, nil, 0, 0, Hash{}) {
+		t.Error("verified a proof for empty data")
+	}
+}
+
+// TestSegmentHash checks that the final leaf of a tree is hashed without
+// padding.
+func TestSegmentHash(t *testing.T) {
+	data := fastrand.Bytes((2 * SegmentSize) + 10)
+	tree := NewCachedTree(0)
+	tree.Push(SegmentHash(data[:SegmentSize]))
+	tree.Push(SegmentHash(data[SegmentSize : 2*SegmentSize]))
+	tree.Push(SegmentHash(data[2*SegmentSize:]))
+	if tree.Root() != MerkleRoot(data) {
+		t.Fatal("segment hashes do not produce the Merkle root")
+	}
+	padded := append(append([]byte(nil), data[2*SegmentSize:]...), make([]byte, SegmentSize-10)...)
+	if SegmentHash(padded) == SegmentHash(data[2*SegmentSize:]) {
+		t.Fatal("padded and unpadded segments have the same hash")
+	}
+}
+
 // TestCachedTree tests the cached tree functions of the package.
 func TestCachedTree(t *testing.T) {
 	if testing.Short() {
@@ -132,6 +683,184 @@ func TestCachedTree(t *testing.T) {
 	}
 }
 
+// TestCachedTreeProveMulti checks that a single cached tree can extend proofs
+// for several subtrees at once.
+func TestCachedTreeProveMulti(t *testing.T) {
+	// Build a cached tree out of 5 subtrees, each of height 2.
+	var data []byte
+	ct := NewCachedTree(2)
+	for i := 0; i < 5; i++ {
+		subtreeBytes := fastrand.Bytes(SegmentSize * 4)
+		data = append(data, subtreeBytes...)
+		ct.Push(MerkleRoot(subtreeBytes))
+	}
+	fullRoot := MerkleRoot(data)
+
+	var proofs []CachedSubProof
+	for _, index := range []uint64{0, 6, 7, 13, 19} {
+		subtreeStart := (index / 4) * 4 * SegmentSize
+		base, cachedHashSet := MerkleProof(data[subtreeStart:subtreeStart+4*SegmentSize], index%4)
+		proofs = append(proofs, CachedSubProof{
+			Index:         index,
+			Base:          base,
+			CachedHashSet: cachedHashSet,
+		})
+	}
+	proofs = append(proofs, CachedSubProof{Index: 20})
+	hashSets := ct.ProveMulti(proofs)
+	for i, p := range proofs[:len(proofs)-1] {
+		if !VerifySegment(p.Base, hashSets[i], 5*4, p.Index, fullRoot) {
+			t.Error("cached proof for index", p.Index, "did not verify")
+		}
+		if !ct.Verify(p.Base, hashSets[i], p.Index) {
+			t.Error("cached tree did not verify its proof for index", p.Index)
+		}
+		if ct.Verify(p.Base, hashSets[i], p.Index^1) {
+			t.Error("cached tree verified a proof at the wrong index", p.Index^1)
+		}
+	}
+	if hashSets[len(hashSets)-1] != nil {
+		t.Error("expected no proof for an index outside the cached tree")
+	}
+}
+
+// TestReadOnlyProver checks that a ReadOnlyProver can be used from many
+// goroutines at once.
+func TestReadOnlyProver(t *testing.T) {
+	var data []byte
+	ct := NewCachedTree(2)
+	for i := 0; i < 6; i++ {
+		subtreeBytes := fastrand.Bytes(SegmentSize * 4)
+		data = append(data, subtreeBytes...)
+		ct.Push(MerkleRoot(subtreeBytes))
+	}
+	fullRoot := MerkleRoot(data)
+	prover := ct.Prover()
+
+	// Pushing more subtrees should not affect the prover.
+	ct.Push(HashObject("extra"))
+
+	var wg sync.WaitGroup
+	for index := uint64(0); index < 24; index++ {
+		wg.Add(1)
+		go func(index uint64) {
+			defer wg.Done()
+			subtreeStart := (index / 4) * 4 * SegmentSize
+			base, cachedHashSet := MerkleProof(data[subtreeStart:subtreeStart+4*SegmentSize], index%4)
+			hashSet := prover.Prove(CachedSubProof{
+				Index:         index,
+				Base:          base,
+				CachedHashSet: cachedHashSet,
+			})
+			if !VerifySegment(base, hashSet, 24, index, fullRoot) {
+				t.Error("proof from the read-only prover did not verify for index", index)
+			}
+		}(index)
+	}
+	wg.Wait()
+	if prover.Prove(CachedSubProof{Index: 24}) != nil {
+		t.Error("expected no proof for an index outside the prover's subtrees")
+	}
+}
+
+// TestCachedTreeGeometry checks the accessors that describe the layout of a
+// cached tree.
+func TestCachedTreeGeometry(t *testing.T) {
+	ct := NewCachedTree(3)
+	if ct.SubtreeHeight() != 3 {
+		t.Error("wrong subtree height:", ct.SubtreeHeight())
+	}
+	for i := 0; i < 5; i++ {
+		ct.Push(HashObject(i))
+	}
+	if ct.NumSubtrees() != 5 {
+		t.Error("wrong number of subtrees:", ct.NumSubtrees())
+	}
+	if ct.GlobalIndex(0, 0) != 0 || ct.GlobalIndex(0, 7) != 7 || ct.GlobalIndex(2, 5) != 21 {
+		t.Error("GlobalIndex returned the wrong index")
+	}
+	if !ct.Compatible(NewCachedTree(3)) || ct.Compatible(NewCachedTree(4)) {
+		t.Error("Compatible did not compare the subtree heights")
+	}
+	if !ct.Compatible(NewCachedTreeWithSegmentSize(3, SegmentSize)) || ct.Compatible(NewCachedTreeWithSegmentSize(3, 2*SegmentSize)) {
+		t.Error("Compatible did not compare the segment sizes")
+	}
+}
+
+// TestToCachedTree checks that a tree can be converted to a cached tree that
+// has the same root and can extend cached proofs.
+func TestToCachedTree(t *testing.T) {
+	for _, numSegments := range []int{1, 4, 7, 16, 21} {
+		data := fastrand.Bytes(SegmentSize*numSegments - 3)
+		for _, height := range []uint64{0, 1, 2, 3} {
+			tree := NewTree()
+			if err := tree.CacheSubtrees(height); err != nil {
+				t.Fatal(err)
+			}
+			tree.SetIndex(uint64(numSegments / 2))
+			if _, err := tree.PushReader(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			ct, err := tree.ToCachedTree(height)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct.Root() != tree.Root() {
+				t.Fatalf("cached tree has the wrong root for %v segments at height %v", numSegments, height)
+			}
+			base, hashSet := tree.ProveHashSet()
+			if !VerifySegment(base, hashSet, uint64(numSegments), uint64(numSegments/2), ct.Root()) {
+				t.Fatal("proof from a caching tree did not verify")
+			}
+		}
+	}
+
+	tree := NewTree()
+	if _, err := tree.ToCachedTree(0); err != errSubtreesNotCached {
+		t.Error("expected errSubtreesNotCached, got", err)
+	}
+	tree.CacheSubtrees(2)
+	if _, err := tree.ToCachedTree(3); err != errSubtreesNotCached {
+		t.Error("expected errSubtreesNotCached, got", err)
+	}
+	tree.PushObject(0)
+	if err := tree.CacheSubtrees(2); err == nil {
+		t.Error("expected an error when caching subtrees after pushing leaves")
+	}
+}
+
+// TestCachedTreePushAllFrom checks that pushing subtree roots from a reader
+// is the same as pushing them individually.
+func TestCachedTreePushAllFrom(t *testing.T) {
+	var buf bytes.Buffer
+	ct := NewCachedTree(3)
+	for i := 0; i < 7; i++ {
+		h := HashObject(i)
+		buf.Write(h[:])
+		ct.Push(h)
+	}
+	encoded := buf.Bytes()
+
+	readCT := NewCachedTree(3)
+	n, err := readCT.PushAllFrom(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 7 {
+		t.Fatal("expected 7 roots to be pushed, got", n)
+	} else if readCT.Root() != ct.Root() {
+		t.Fatal("PushAllFrom produced the wrong root")
+	}
+
+	// A trailing partial root should produce an error.
+	readCT = NewCachedTree(3)
+	n, err = readCT.PushAllFrom(bytes.NewReader(encoded[:len(encoded)-1]))
+	if err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	} else if n != 6 {
+		t.Error("expected 6 roots to be pushed, got", n)
+	}
+}
+
 // TestMerkleTreeOddDataSize checks that MerkleRoot and MerkleProof still
 // function correctly if you provide data which does not have a size evenly
 // divisible by SegmentSize.
@@ -153,3 +882,1144 @@ func TestOddDataSize(t *testing.T) {
 		}
 	}
 }
+
+// TestReaderMerkleRoot checks that ReaderMerkleRoot and
+// ReaderMerkleRootParallel match MerkleRoot for a variety of data sizes.
+func TestReaderMerkleRoot(t *testing.T) {
+	sizes := []int{
+		0, 1, SegmentSize, SegmentSize*7 + 10,
+		parallelChunkSize - 1, parallelChunkSize, parallelChunkSize + 1,
+		parallelChunkSize*3 + SegmentSize*5 + 3, parallelChunkSize * 4,
+	}
+	for _, size := range sizes {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		readerRoot, err := ReaderMerkleRoot(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		} else if readerRoot != root {
+			t.Error("ReaderMerkleRoot does not match MerkleRoot for size", size)
+		}
+		for _, workers := range []int{0, 1, 3} {
+			parallelRoot, err := ReaderMerkleRootParallel(bytes.NewReader(data), int64(size), workers)
+			if err != nil {
+				t.Fatal(err)
+			} else if parallelRoot != root {
+				t.Errorf("ReaderMerkleRootParallel with %v workers does not match MerkleRoot for size %v", workers, size)
+			}
+		}
+	}
+
+	// A reader that is shorter than the declared size should produce an
+	// error.
+	_, err := ReaderMerkleRootParallel(bytes.NewReader(make([]byte, 100)), 200, 2)
+	if err == nil {
+		t.Error("expected an error when the reader is too short")
+	}
+}
+
+// TestFileMerkleRoot checks that FileMerkleRoot matches MerkleRoot for files
+// of a variety of sizes.
+func TestFileMerkleRoot(t *testing.T) {
+	dir := build.TempDir("crypto", t.Name())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, SegmentSize*7 + 10, mmapChunkSize + SegmentSize + 1} {
+		data := fastrand.Bytes(size)
+		path := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		root, err := FileMerkleRoot(path)
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(data) {
+			t.Error("FileMerkleRoot does not match MerkleRoot for size", size)
+		}
+	}
+
+	// A file that does not exist should produce an error.
+	if _, err := FileMerkleRoot(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// TestSegmentSize checks that trees and proofs can be built with a custom
+// segment size.
+func TestSegmentSize(t *testing.T) {
+	const segmentSize = 1024
+	data := fastrand.Bytes(segmentSize*5 + 100)
+	numSegments := uint64(6)
+
+	// The root should be the same as pushing segmentSize leaves manually.
+	tree := NewTreeWithSegmentSize(segmentSize)
+	buf := bytes.NewBuffer(data)
+	for buf.Len() > 0 {
+		tree.Push(buf.Next(segmentSize))
+	}
+	root, err := ReaderMerkleRootSegSize(bytes.NewReader(data), segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	} else if root != tree.Root() {
+		t.Fatal("ReaderMerkleRootSegSize does not match the manually built tree")
+	} else if root == MerkleRoot(data) {
+		t.Fatal("custom segment size produced the same root as the default")
+	}
+
+	for i := uint64(0); i < numSegments; i++ {
+		base, hashSet, err := BuildReaderProofSegSize(bytes.NewReader(data), i, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifySegmentSegSize(base, hashSet, numSegments, i, root, segmentSize) {
+			t.Error("proof", i, "did not verify")
+		}
+		if i != numSegments-1 && VerifySegmentSegSize(base[1:], hashSet, numSegments, i, root, segmentSize) {
+			t.Error("verified a short base segment for a non-final index")
+		}
+	}
+
+	// The default proof functions should agree with MerkleProof.
+	base, hashSet, err := BuildReaderProof(bytes.NewReader(data), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expBase, expHashSet := MerkleProof(data, 3)
+	if !bytes.Equal(base, expBase) || len(hashSet) != len(expHashSet) {
+		t.Fatal("BuildReaderProof does not match MerkleProof")
+	}
+	if _, _, err := BuildReaderProof(bytes.NewReader(data), 1000); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if _, _, err := BuildReaderProof(bytes.NewReader(data[:SegmentSize*3]), 5); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange for a 3 leaf reader, got", err)
+	}
+	if _, err := ReaderMerkleRootSegSize(bytes.NewReader(data), 0); err != ErrInvalidSegmentSize {
+		t.Error("expected ErrInvalidSegmentSize, got", err)
+	}
+}
+
+// TestVerifySegmentErr checks that VerifySegmentErr returns the right error
+// for each kind of bad proof, and that VerifySegment agrees with
+// merkletree.VerifyProof.
+func TestVerifySegmentErr(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*6 + 20)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 2)
+	if err := VerifySegmentErr(base, hashSet, 7, 2, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySegmentErr(base, hashSet, 7, 7, root); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if err := VerifySegmentErr(base, hashSet[1:], 7, 2, root); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if err := VerifySegmentErr(base, append(hashSet, Hash{}), 7, 2, root); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if err := VerifySegmentErr(base, hashSet, 7, 3, root); err != ErrRootMismatch {
+		t.Error("expected ErrRootMismatch, got", err)
+	}
+
+	// Compare against merkletree for every index of every tree size, using
+	// both correct and incorrect leaf counts.
+	for numLeaves := uint64(1); numLeaves < 35; numLeaves++ {
+		data := fastrand.Bytes(int(numLeaves) * SegmentSize)
+		root := MerkleRoot(data)
+		for i := uint64(0); i < numLeaves; i++ {
+			base, hashSet := MerkleProof(data, i)
+			proofSet := [][]byte{base}
+			for j := range hashSet {
+				proofSet = append(proofSet, hashSet[j][:])
+			}
+			for _, n := range []uint64{numLeaves - 1, numLeaves, numLeaves + 1} {
+				exp := merkletree.VerifyProof(NewHash(), root[:], proofSet, i, n)
+				if VerifySegment(base, hashSet, n, i, root) != exp {
+					t.Fatalf("VerifySegment disagrees with merkletree for index %v of %v leaves", i, n)
+				}
+			}
+		}
+	}
+}
+
+// TestTreeHasher checks that trees can be built with SHA-256 in place of
+// blake2b, using the same leaf and node prefixes.
+func TestTreeHasher(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*2 + 5)
+	root, err := ReaderMerkleRootHasher(bytes.NewReader(data), sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == MerkleRoot(data) {
+		t.Fatal("SHA-256 tree has the same root as the blake2b tree")
+	}
+
+	// Compute the root by hand.
+	leaf := func(b []byte) [32]byte { return sha256.Sum256(append([]byte{0}, b...)) }
+	node := func(l, r [32]byte) [32]byte { return sha256.Sum256(append(append([]byte{1}, l[:]...), r[:]...)) }
+	expected := node(node(leaf(data[:SegmentSize]), leaf(data[SegmentSize:2*SegmentSize])), leaf(data[2*SegmentSize:]))
+	if root != Hash(expected) {
+		t.Fatal("SHA-256 tree has the wrong root")
+	}
+
+	// The state of a tree with a custom hasher cannot be marshalled.
+	if _, err := NewTreeHasher(sha256.New()).MarshalState(); err != errHasherTreeState {
+		t.Error("expected errHasherTreeState, got", err)
+	}
+
+	// Hashers that do not produce HashSize-byte digests are rejected.
+	if _, err := ReaderMerkleRootHasher(bytes.NewReader(data), sha512.New); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+}
+
+// TestDiffProof checks that a single-segment update can be proven.
+func TestDiffProof(t *testing.T) {
+	oldData := fastrand.Bytes(SegmentSize*9 + 30)
+	newData := append([]byte(nil), oldData...)
+	copy(newData[4*SegmentSize:], fastrand.Bytes(SegmentSize))
+	oldRoot, newRoot := MerkleRoot(oldData), MerkleRoot(newData)
+
+	oldSegment, hashSet, err := BuildDiffProof(bytes.NewReader(oldData), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSegment := newData[4*SegmentSize : 5*SegmentSize]
+	if !VerifyDiffProof(oldSegment, newSegment, hashSet, 10, 4, oldRoot, newRoot) {
+		t.Fatal("diff proof did not verify")
+	}
+
+	// Changing a second segment should cause verification to fail.
+	newData[0]++
+	if VerifyDiffProof(oldSegment, newSegment, hashSet, 10, 4, oldRoot, MerkleRoot(newData)) {
+		t.Error("diff proof verified an update that changed two segments")
+	}
+	if VerifyDiffProof(oldSegment, newSegment, hashSet, 10, 5, oldRoot, newRoot) {
+		t.Error("diff proof verified at the wrong index")
+	}
+	if VerifyDiffProof(oldSegment, newSegment[1:], hashSet, 10, 4, oldRoot, newRoot) {
+		t.Error("diff proof verified a short segment in the middle of the tree")
+	}
+}
+
+// TestReaderMerkleRootCtx checks that ReaderMerkleRootCtx can be cancelled.
+func TestReaderMerkleRootCtx(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*100 + 1)
+	root, err := ReaderMerkleRootCtx(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if root != MerkleRoot(data) {
+		t.Fatal("ReaderMerkleRootCtx does not match MerkleRoot")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReaderMerkleRootCtx(ctx, bytes.NewReader(data)); err != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+}
+
+// TestProofPath checks that combining each proof hash on the side given by
+// ProofPath reproduces the Merkle root.
+func TestProofPath(t *testing.T) {
+	for _, numLeaves := range []uint64{1, 2, 5, 8, 13} {
+		data := fastrand.Bytes(int(numLeaves) * SegmentSize)
+		root := MerkleRoot(data)
+		for index := uint64(0); index < numLeaves; index++ {
+			base, hashSet := MerkleProof(data, index)
+			path := ProofPath(numLeaves, index)
+			if len(path) != len(hashSet) {
+				t.Fatalf("path for index %v of %v leaves has the wrong length", index, numLeaves)
+			}
+			sum := leafSum(base)
+			for i, left := range path {
+				if left {
+					sum = nodeSum(hashSet[i], sum)
+				} else {
+					sum = nodeSum(sum, hashSet[i])
+				}
+			}
+			if sum != root {
+				t.Fatalf("path for index %v of %v leaves does not produce the root", index, numLeaves)
+			}
+		}
+	}
+	// Leaf 2 of 5 is joined with leaf 3 on its right, then leaves 0 and 1 on
+	// the left, then leaf 4 on the right.
+	if path := ProofPath(5, 2); len(path) != 3 || path[0] || !path[1] || path[2] {
+		t.Error("wrong path for leaf 2 of 5:", path)
+	}
+	if len(ProofPath(5, 5)) != 0 {
+		t.Error("path returned for an index past the end of the tree")
+	}
+}
+
+// TestVerifySegmentShortFinalLeaf checks that a short final segment verifies
+// as-is, and does not verify if it is padded.
+func TestVerifySegmentShortFinalLeaf(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*4 + 10)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 4)
+	if len(base) != 10 || !VerifySegment(base, hashSet, 5, 4, root) {
+		t.Fatal("short final segment did not verify")
+	}
+	padded := append(append([]byte(nil), base...), make([]byte, SegmentSize-len(base))...)
+	if VerifySegment(padded, hashSet, 5, 4, root) {
+		t.Fatal("padded final segment verified")
+	}
+	base, hashSet = MerkleProof(data, 2)
+	if VerifySegmentSegSize(base[:10], hashSet, 5, 2, root, SegmentSize) {
+		t.Fatal("short segment verified at a non-final index")
+	}
+}
+
+// TestVerifyWithSize checks that VerifyWithSize reports indices past the end
+// of the claimed data.
+func TestVerifyWithSize(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*6 + 12)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 6)
+	if ok, err := VerifyWithSize(base, hashSet, uint64(len(data)), 6, root); err != nil || !ok {
+		t.Fatal("proof did not verify with the correct size:", err)
+	}
+	if ok, err := VerifyWithSize(base, hashSet, uint64(len(data))+1, 6, root); err != nil || ok {
+		t.Fatal("proof verified with the wrong size:", err)
+	}
+	if _, err := VerifyWithSize(base, hashSet, SegmentSize*6, 6, root); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if _, err := VerifyWithSize(nil, nil, 0, 0, EmptyRoot()); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange for empty data, got", err)
+	}
+}
+
+// TestChannelMerkleRoot checks that ChannelMerkleRoot matches MerkleRoot, and
+// rejects malformed segments without blocking the sender.
+func TestChannelMerkleRoot(t *testing.T) {
+	send := func(segments ...[]byte) (Hash, error) {
+		ch := make(chan []byte)
+		go func() {
+			for _, segment := range segments {
+				ch <- segment
+			}
+			close(ch)
+		}()
+		return ChannelMerkleRoot(ch)
+	}
+
+	data := fastrand.Bytes(SegmentSize*9 + 17)
+	var segments [][]byte
+	for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+		segments = append(segments, buf.Next(SegmentSize))
+	}
+	if root, err := send(segments...); err != nil || root != MerkleRoot(data) {
+		t.Fatal("ChannelMerkleRoot does not match MerkleRoot:", err)
+	}
+	if root, err := send(); err != nil || root != EmptyRoot() {
+		t.Fatal("root of no segments is not EmptyRoot:", err)
+	}
+
+	if _, err := send(data[:SegmentSize], data[:SegmentSize+1], data[:SegmentSize]); err != ErrSegmentTooLarge {
+		t.Error("expected ErrSegmentTooLarge, got", err)
+	}
+	if _, err := send(data[:SegmentSize], data[:10], data[:SegmentSize]); err != errShortSegment {
+		t.Error("expected errShortSegment, got", err)
+	}
+}
+
+// TestProofLargeTree checks proofs for indices above 2^32 in a virtual tree
+// of zero segments, whose subtree roots are computed without hashing every
+// leaf.
+func TestProofLargeTree(t *testing.T) {
+	segment := make([]byte, SegmentSize)
+	zeros := []Hash{leafSum(segment)}
+	for h := 1; h < 64; h++ {
+		zeros = append(zeros, nodeSum(zeros[h-1], zeros[h-1]))
+	}
+
+	// zeroTreeProof returns the root of a tree of 'numLeaves' zero segments,
+	// which is made of one perfect subtree of zero segments for every bit set
+	// in the leaf count, and builds the proof for 'index' from the structure
+	// of the tree: the zero subtrees below the leaf, the root of everything
+	// to its right, and each subtree to its left.
+	zeroTreeProof := func(numLeaves, index uint64) (Hash, []Hash) {
+		var stack subtreeStack
+		var start uint64
+		for height := uint64(63); ; height-- {
+			if numLeaves&(1<<height) != 0 {
+				stack = append(stack, subtree{index: start, height: height, sum: zeros[height]})
+				start += 1 << height
+			}
+			if height == 0 {
+				break
+			}
+		}
+		k := len(stack) - 1
+		for stack[k].index > index {
+			k--
+		}
+		var hashSet []Hash
+		for h := uint64(0); h < stack[k].height; h++ {
+			hashSet = append(hashSet, zeros[h])
+		}
+		if k < len(stack)-1 {
+			hashSet = append(hashSet, stack[k+1:].root())
+		}
+		for i := k - 1; i >= 0; i-- {
+			hashSet = append(hashSet, stack[i].sum)
+		}
+		return stack.root(), hashSet
+	}
+
+	const numLeaves uint64 = 1<<40 + 1<<33 + 5
+	for _, index := range []uint64{1<<32 + 7, 1<<40 + 1<<32 + 3, numLeaves - 2, numLeaves - 1} {
+		root, hashSet := zeroTreeProof(numLeaves, index)
+		if ProofSize(numLeaves, index) != len(hashSet) || len(ProofPath(numLeaves, index)) != len(hashSet) {
+			t.Fatalf("wrong proof size for index %v: %v", index, ProofSize(numLeaves, index))
+		}
+		if !VerifySegment(segment, hashSet, numLeaves, index, root) {
+			t.Fatal("proof did not verify for index", index)
+		}
+		if !VerifySegmentBuf(make([]byte, VerifyScratchSize), segment, hashSet, numLeaves, index, root) {
+			t.Fatal("VerifySegmentBuf did not verify index", index)
+		}
+		hashSet[len(hashSet)-1][0]++
+		if VerifySegment(segment, hashSet, numLeaves, index, root) {
+			t.Fatal("corrupt proof verified for index", index)
+		}
+	}
+
+	// Build proofs with a cached tree whose subtrees are 2^30 zero segments
+	// each, and check that they match the structure of the tree.
+	const cachedHeight = 30
+	const cachedLeaves uint64 = 1<<40 + 1<<33 + 5<<cachedHeight
+	cachedHashSet := zeros[:cachedHeight]
+	for _, index := range []uint64{1<<32 + 7, 1<<40 + 1<<32 + 3, cachedLeaves - 2, cachedLeaves - 1} {
+		ct := NewCachedTree(cachedHeight)
+		ct.SetIndex(index)
+		for i := uint64(0); i < cachedLeaves>>cachedHeight; i++ {
+			ct.Push(zeros[cachedHeight])
+		}
+		root, expected := zeroTreeProof(cachedLeaves, index)
+		if ct.Root() != root {
+			t.Fatal("cached tree has the wrong root")
+		}
+		hashSet := ct.Prove(segment, cachedHashSet)
+		multi := ct.ProveMulti([]CachedSubProof{{Index: index, Base: segment, CachedHashSet: cachedHashSet}})
+		if len(hashSet) != len(expected) || len(multi[0]) != len(expected) {
+			t.Fatal("cached proof has the wrong size for index", index)
+		}
+		for i := range expected {
+			if hashSet[i] != expected[i] || multi[0][i] != expected[i] {
+				t.Fatal("cached proof does not match the tree for index", index)
+			}
+		}
+		if !VerifySegment(segment, hashSet, cachedLeaves, index, root) {
+			t.Fatal("cached proof did not verify for index", index)
+		}
+	}
+}
+
+// TestRootAndProof checks that RootAndProof matches MerkleRoot and
+// MerkleProof.
+func TestRootAndProof(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*10 + 33)
+	for _, index := range []uint64{0, 4, 10} {
+		root, base, hashSet, err := RootAndProof(bytes.NewReader(data), int64(len(data)), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expBase, expHashSet := MerkleProof(data, index)
+		if root != MerkleRoot(data) || !bytes.Equal(base, expBase) || len(hashSet) != len(expHashSet) {
+			t.Fatal("RootAndProof does not match MerkleRoot and MerkleProof for index", index)
+		}
+		if !VerifySegment(base, hashSet, 11, index, root) {
+			t.Fatal("proof did not verify for index", index)
+		}
+	}
+	if _, _, _, err := RootAndProof(bytes.NewReader(data), int64(len(data)), 11); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if _, _, _, err := RootAndProof(bytes.NewReader(data), int64(len(data))+1, 0); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF when the reader is too short, got", err)
+	}
+
+	// Data larger than a single buffered read.
+	data = fastrand.Bytes(bufferedReadSize*3 + 17)
+	index := CalculateLeaves(uint64(len(data))) - 1
+	root, base, hashSet, err := RootAndProof(bytes.NewReader(data), int64(len(data)), index)
+	if err != nil {
+		t.Fatal(err)
+	} else if root != MerkleRoot(data) {
+		t.Fatal("RootAndProof returned the wrong root for large data")
+	} else if !VerifySegmentBySize(base, hashSet, uint64(len(data)), index, root) {
+		t.Fatal("proof did not verify for large data")
+	}
+}
+
+// TestVerifySegmentFlat checks that a proof verifies with its hashes
+// concatenated, and that malformed hash sets are rejected.
+func TestVerifySegmentFlat(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*12 + 5)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 9)
+	var flat []byte
+	for _, h := range hashSet {
+		flat = append(flat, h[:]...)
+	}
+	if ok, err := VerifySegmentFlat(base, flat, 13, 9, root); err != nil || !ok {
+		t.Fatal("flat proof did not verify:", err)
+	}
+	if ok, err := VerifySegmentFlat(base, flat, 13, 8, root); err != nil || ok {
+		t.Fatal("flat proof verified for the wrong index:", err)
+	}
+	if _, err := VerifySegmentFlat(base, flat[1:], 13, 9, root); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+	if _, err := VerifySegmentFlat(base, flat[HashSize:], 13, 9, root); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := VerifySegmentFlat(base, flat, 13, 13, root); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+}
+
+// TestReaderMerkleTree checks that every node returned by ReaderMerkleTree is
+// the root of the leaves it covers.
+func TestReaderMerkleTree(t *testing.T) {
+	for _, size := range []int{1, SegmentSize * 8, SegmentSize*13 + 7} {
+		data := fastrand.Bytes(size)
+		levels, err := ReaderMerkleTree(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		top := levels[len(levels)-1]
+		if len(top) != 1 || top[0] != MerkleRoot(data) {
+			t.Fatal("top level is not the Merkle root for size", size)
+		}
+		for h, level := range levels {
+			for i, node := range level {
+				start := uint64(i<<uint(h)) * SegmentSize
+				end := uint64((i+1)<<uint(h)) * SegmentSize
+				if end > uint64(size) {
+					end = uint64(size)
+				}
+				if node != MerkleRoot(data[start:end]) {
+					t.Fatalf("wrong node %v at level %v for size %v", i, h, size)
+				}
+			}
+		}
+	}
+	if levels, err := ReaderMerkleTree(bytes.NewReader(nil)); err != nil || levels != nil {
+		t.Error("empty data should have no levels:", err)
+	}
+}
+
+// TestReaderMerkleRootProgress checks that ReaderMerkleRootProgress matches
+// ReaderMerkleRoot and reports progress at the expected intervals.
+func TestReaderMerkleRootProgress(t *testing.T) {
+	for _, size := range []int{0, 10, progressInterval, progressInterval*2 + 5} {
+		data := fastrand.Bytes(size)
+		var calls []int64
+		root, err := ReaderMerkleRootProgress(bytes.NewReader(data), func(n int64) {
+			calls = append(calls, n)
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(data) {
+			t.Fatal("ReaderMerkleRootProgress does not match MerkleRoot for size", size)
+		}
+		expCalls := size / progressInterval
+		if size%progressInterval != 0 || size == 0 {
+			expCalls++
+		}
+		if len(calls) != expCalls {
+			t.Fatalf("wrong number of progress calls for size %v: %v", size, calls)
+		}
+		for i, n := range calls[:len(calls)-1] {
+			if n != int64(i+1)*progressInterval {
+				t.Fatalf("wrong progress for size %v: %v", size, calls)
+			}
+		}
+		if calls[len(calls)-1] != int64(size) {
+			t.Fatalf("final progress call for size %v reported %v bytes", size, calls[len(calls)-1])
+		}
+	}
+}
+
+// TestVerifySegmentData checks that VerifySegmentData only accepts the data
+// that is actually at the proven index.
+func TestVerifySegmentData(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*6 + 17)
+	root := MerkleRoot(data)
+	for _, index := range []uint64{0, 3, 6} {
+		_, hashSet, err := BuildReaderProof(bytes.NewReader(data), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, end := LeafRange(index)
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		if !VerifySegmentData(data[start:end], hashSet, 7, index, root) {
+			t.Fatal("expected data did not verify at index", index)
+		}
+		wrong := append([]byte(nil), data[start:end]...)
+		wrong[0]++
+		if VerifySegmentData(wrong, hashSet, 7, index, root) {
+			t.Error("wrong data verified at index", index)
+		}
+	}
+
+	// The final leaf must not be padded.
+	_, hashSet, _ := BuildReaderProof(bytes.NewReader(data), 6)
+	padded := append(append([]byte(nil), data[SegmentSize*6:]...), make([]byte, SegmentSize-17)...)
+	if VerifySegmentData(padded, hashSet, 7, 6, root) {
+		t.Error("padded final leaf verified")
+	}
+}
+
+// TestMerkleRootOfSegments checks that MerkleRootOfSegments matches
+// MerkleRoot, and does not allocate for well-formed segments.
+func TestMerkleRootOfSegments(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize, SegmentSize*5 + 3, SegmentSize * 16} {
+		data := fastrand.Bytes(size)
+		var segments [][]byte
+		buf := bytes.NewBuffer(data)
+		for buf.Len() > 0 {
+			segments = append(segments, buf.Next(SegmentSize))
+		}
+		if MerkleRootOfSegments(segments) != MerkleRoot(data) {
+			t.Fatal("MerkleRootOfSegments does not match MerkleRoot for size", size)
+		}
+		if allocs := testing.AllocsPerRun(10, func() { MerkleRootOfSegments(segments) }); allocs != 0 {
+			t.Error("MerkleRootOfSegments allocated", allocs, "times for size", size)
+		}
+	}
+
+	// Irregular segments should still match the root of their concatenation.
+	segments := [][]byte{fastrand.Bytes(10), fastrand.Bytes(SegmentSize * 2), {}, fastrand.Bytes(7)}
+	if MerkleRootOfSegments(segments) != MerkleRoot(bytes.Join(segments, nil)) {
+		t.Fatal("MerkleRootOfSegments does not match MerkleRoot for irregular segments")
+	}
+}
+
+// TestProofSize checks that ProofSize matches the length of the proofs built
+// by BuildReaderProof.
+func TestProofSize(t *testing.T) {
+	for _, size := range []int{1, SegmentSize, SegmentSize*7 + 10, SegmentSize * 8, SegmentSize*13 + 1} {
+		data := fastrand.Bytes(size)
+		numLeaves := CalculateLeaves(uint64(size))
+		for index := uint64(0); index < numLeaves; index++ {
+			_, hashSet, err := BuildReaderProof(bytes.NewReader(data), index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ProofSize(numLeaves, index) != len(hashSet) {
+				t.Fatalf("ProofSize(%v, %v) = %v, expected %v", numLeaves, index, ProofSize(numLeaves, index), len(hashSet))
+			}
+		}
+		if ProofSize(numLeaves, numLeaves) != 0 {
+			t.Error("expected 0 for an out-of-range index")
+		}
+	}
+}
+
+// TestReaderAtMerkleRoot checks that ReaderAtMerkleRoot matches MerkleRoot.
+func TestReaderAtMerkleRoot(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize, SegmentSize*9 + 30, SegmentSize * 32} {
+		data := fastrand.Bytes(size)
+		root, err := ReaderAtMerkleRoot(bytes.NewReader(data), int64(size))
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(data) {
+			t.Fatal("ReaderAtMerkleRoot does not match MerkleRoot for size", size)
+		}
+	}
+
+	// Asking for more data than the reader holds should fail.
+	data := fastrand.Bytes(SegmentSize * 2)
+	if _, err := ReaderAtMerkleRoot(bytes.NewReader(data), int64(len(data)+1)); err == nil {
+		t.Error("expected an error when the reader is too short")
+	}
+}
+
+// TestBuildAndVerify throws random data and indices at BuildAndVerify.
+func TestBuildAndVerify(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		data := fastrand.Bytes(fastrand.Intn(SegmentSize * 40))
+		numLeaves := CalculateLeaves(uint64(len(data)))
+		index := uint64(fastrand.Intn(int(numLeaves) + 2))
+		ok, err := BuildAndVerify(data, index)
+		if len(data) == 0 || index >= numLeaves {
+			if err != ErrIndexOutOfRange {
+				t.Fatal("expected ErrIndexOutOfRange, got", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("proof for index %v of %v bytes did not verify", index, len(data))
+		}
+	}
+}
+
+// TestJoinRoots checks that subtree roots can be joined into the full root.
+func TestJoinRoots(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize * 16)
+	var roots []Hash
+	for i := 0; i < 4; i++ {
+		roots = append(roots, MerkleRoot(data[i*4*SegmentSize:(i+1)*4*SegmentSize]))
+	}
+	if JoinRoots(JoinRoots(roots[0], roots[1]), JoinRoots(roots[2], roots[3])) != MerkleRoot(data) {
+		t.Fatal("joined roots do not match the full root")
+	}
+
+	// 7 segments are made of subtrees of 4, 2, and 1 segments.
+	data = data[:SegmentSize*7]
+	a := MerkleRoot(data[:4*SegmentSize])
+	b := MerkleRoot(data[4*SegmentSize : 6*SegmentSize])
+	c := MerkleRoot(data[6*SegmentSize:])
+	if JoinRoots(a, JoinRoots(b, c)) != MerkleRoot(data) {
+		t.Fatal("joined roots do not match the full root of an unbalanced tree")
+	}
+}
+
+// TestLeafHash checks that LeafHash produces the hash pushed by PushObject.
+func TestLeafHash(t *testing.T) {
+	objs := []interface{}{"foo", uint64(7), []Hash{HashObject(1), HashObject(2)}}
+	tree := NewTree()
+	ct := NewCachedTree(0)
+	for _, obj := range objs {
+		tree.PushObject(obj)
+		h, err := LeafHash(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.Push(h)
+	}
+	if ct.Root() != tree.Root() {
+		t.Fatal("leaf hashes do not match PushObject")
+	}
+	if _, err := LeafHash(map[int]int{}); err == nil {
+		t.Error("expected an error for an object that cannot be encoded")
+	}
+}
+
+// rawMarshaler is a SiaMarshaler that writes its bytes without a length
+// prefix, or fails if it is empty.
+type rawMarshaler []byte
+
+func (rm rawMarshaler) MarshalSia(w io.Writer) error {
+	if len(rm) == 0 {
+		return errors.New("empty rawMarshaler")
+	}
+	_, err := w.Write(rm)
+	return err
+}
+
+// TestPushEncoded checks that PushEncoded pushes the object's own encoding and
+// agrees with LeafHash and PushObject.
+func TestPushEncoded(t *testing.T) {
+	m := rawMarshaler("custom leaf")
+	tree := NewTree()
+	if err := tree.PushEncoded(m); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Root() != leafSum([]byte("custom leaf")) {
+		t.Fatal("PushEncoded did not push the object's own encoding")
+	}
+	if h, err := LeafHash(m); err != nil || h != tree.Root() {
+		t.Fatal("LeafHash does not match PushEncoded", err)
+	}
+	objTree := NewTree()
+	objTree.PushObject(m)
+	if objTree.Root() != tree.Root() {
+		t.Fatal("PushObject does not match PushEncoded")
+	}
+
+	if err := tree.PushEncoded(rawMarshaler(nil)); err == nil {
+		t.Fatal("expected an error from MarshalSia")
+	} else if tree.Root() != objTree.Root() {
+		t.Fatal("a leaf was pushed despite the MarshalSia error")
+	}
+}
+
+// TestLeafProofOf checks that a proof template can be completed once its
+// object has been placed in a tree.
+func TestLeafProofOf(t *testing.T) {
+	leaf, pt := LeafProofOf("deferred")
+	tree := NewTree()
+	var leaves []Hash
+	for i := 0; i < 9; i++ {
+		if i == 5 {
+			tree.PushObject("deferred")
+			leaves = append(leaves, leaf)
+			continue
+		}
+		tree.PushObject(i)
+		h, err := LeafHash(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, h)
+	}
+
+	hashSet, err := pt.Complete(leaves, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if !VerifySegment(pt.Base, hashSet, 9, 5, tree.Root()) {
+		t.Fatal("completed proof did not verify")
+	}
+	if _, err := pt.Complete(leaves, 4); err != ErrRootMismatch {
+		t.Error("expected ErrRootMismatch, got", err)
+	}
+	if _, err := pt.Complete(leaves, 9); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+}
+
+// TestBuildReaderProofAtOffset checks that proofs can be built by byte offset,
+// including offsets within the final partial leaf.
+func TestBuildReaderProofAtOffset(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*4 + 20)
+	root := MerkleRoot(data)
+	for _, offset := range []uint64{0, 63, 64, 200, SegmentSize * 4, SegmentSize*4 + 19} {
+		base, hashSet, index, segmentOffset, err := BuildReaderProofAtOffset(bytes.NewReader(data), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != offset/SegmentSize || base[segmentOffset] != data[offset] {
+			t.Fatal("wrong segment or offset for byte", offset)
+		}
+		if !VerifySegment(base, hashSet, 5, index, root) {
+			t.Fatal("proof for byte", offset, "did not verify")
+		}
+	}
+	for _, offset := range []uint64{SegmentSize*4 + 20, SegmentSize * 5, SegmentSize * 9} {
+		if _, _, _, _, err := BuildReaderProofAtOffset(bytes.NewReader(data), offset); err != ErrIndexOutOfRange {
+			t.Error("expected ErrIndexOutOfRange for offset", offset, "got", err)
+		}
+	}
+}
+
+// TestValidateProofShape checks that malformed hash sets are rejected.
+func TestValidateProofShape(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*6 + 5)
+	_, hashSet := MerkleProof(data, 3)
+	raw := make([][]byte, len(hashSet))
+	for i := range hashSet {
+		raw[i] = hashSet[i][:]
+	}
+	if err := ValidateProofShape(raw, 7, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateProofShape(raw, 7, 7); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if err := ValidateProofShape(raw[1:], 7, 3); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	raw[1] = raw[1][:HashSize-1]
+	if err := ValidateProofShape(raw, 7, 3); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+}
+
+// TestProofParams checks that proof shapes can be validated for hashes of
+// other sizes.
+func TestProofParams(t *testing.T) {
+	params := ProofParams{HashLen: 64}
+	hashSet := make([][]byte, ProofSize(7, 3))
+	for i := range hashSet {
+		hashSet[i] = fastrand.Bytes(64)
+	}
+	if err := params.ValidateProofShape(hashSet, 7, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateProofShape(hashSet, 7, 3); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen for the default params, got", err)
+	}
+	hashSet[0] = hashSet[0][:HashSize]
+	if err := params.ValidateProofShape(hashSet, 7, 3); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+}
+
+// TestProofParamsVerifySegment checks that proofs can be verified with hashes
+// of other sizes.
+func TestProofParamsVerifySegment(t *testing.T) {
+	// The default params verify the proofs built by this package.
+	data := fastrand.Bytes(SegmentSize*6 + 5)
+	root := MerkleRoot(data)
+	for index := uint64(0); index < 7; index++ {
+		base, hashSet := MerkleProof(data, index)
+		raw := make([][]byte, len(hashSet))
+		for i := range hashSet {
+			raw[i] = hashSet[i][:]
+		}
+		if ok, err := DefaultProofParams.VerifySegment(base, raw, 7, index, root[:]); err != nil || !ok {
+			t.Fatal("default params did not verify the proof for index", index, err)
+		}
+		if ok, _ := DefaultProofParams.VerifySegment(base, raw, 7, index^1, root[:]); ok {
+			t.Fatal("default params verified a proof at the wrong index")
+		}
+	}
+
+	// Build a tree of 3 leaves with sha512, whose digests are 64 bytes.
+	sum := func(b ...[]byte) []byte {
+		h := sha512.New()
+		for _, x := range b {
+			h.Write(x)
+		}
+		return h.Sum(nil)
+	}
+	leaves := [][]byte{{1}, {2}, {3}}
+	var leafHashes [][]byte
+	for _, leaf := range leaves {
+		leafHashes = append(leafHashes, sum([]byte{LeafHashPrefix}, leaf))
+	}
+	left := sum([]byte{NodeHashPrefix}, leafHashes[0], leafHashes[1])
+	sha512Root := sum([]byte{NodeHashPrefix}, left, leafHashes[2])
+	params := ProofParams{HashLen: sha512.Size, NewHasher: sha512.New}
+	proofs := [][][]byte{
+		{leafHashes[1], leafHashes[2]},
+		{leafHashes[0], leafHashes[2]},
+		{left},
+	}
+	for i, proof := range proofs {
+		if ok, err := params.VerifySegment(leaves[i], proof, 3, uint64(i), sha512Root); err != nil || !ok {
+			t.Fatal("sha512 proof did not verify for index", i, err)
+		}
+		if ok, _ := params.VerifySegment([]byte{9}, proof, 3, uint64(i), sha512Root); ok {
+			t.Fatal("sha512 proof verified with the wrong segment")
+		}
+	}
+	if _, err := params.VerifySegment(leaves[0], proofs[0], 3, 0, root[:]); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen for a root of the wrong size, got", err)
+	}
+	if _, err := DefaultProofParams.VerifySegment(leaves[0], proofs[0], 3, 0, sha512Root); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen for the default params, got", err)
+	}
+	mismatched := ProofParams{HashLen: sha512.Size}
+	if _, err := mismatched.VerifySegment(leaves[0], proofs[0], 3, 0, sha512Root); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen for a hasher of the wrong size, got", err)
+	}
+}
+
+// TestHashPrefixes checks that leaves and nodes can be hashed from the
+// exported prefixes alone.
+func TestHashPrefixes(t *testing.T) {
+	a, b := fastrand.Bytes(SegmentSize), fastrand.Bytes(SegmentSize)
+	leafA := HashBytes(append([]byte{LeafHashPrefix}, a...))
+	leafB := HashBytes(append([]byte{LeafHashPrefix}, b...))
+	root := HashBytes(append(append([]byte{NodeHashPrefix}, leafA[:]...), leafB[:]...))
+	if root != MerkleRoot(append(a, b...)) {
+		t.Fatal("root built from the exported prefixes does not match MerkleRoot")
+	}
+}
+
+// TestZeroSectorRoot checks that ZeroSectorRoot matches the root of actual
+// zeros.
+func TestZeroSectorRoot(t *testing.T) {
+	for _, numLeaves := range []uint64{0, 1, 2, 3, 7, 8, 13, 64, 100} {
+		zeros := make([]byte, numLeaves*SegmentSize)
+		root, err := ReaderMerkleRoot(bytes.NewReader(zeros))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ZeroSectorRoot(numLeaves) != root {
+			t.Error("wrong zero root for", numLeaves, "leaves")
+		}
+	}
+}
+
+// TestBufferedReaderMerkleRoot checks that BufferedReaderMerkleRoot matches
+// MerkleRoot.
+func TestBufferedReaderMerkleRoot(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize*9 + 30, bufferedReadSize*3 + SegmentSize + 1} {
+		data := fastrand.Bytes(size)
+		root, err := BufferedReaderMerkleRoot(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(data) {
+			t.Fatal("BufferedReaderMerkleRoot does not match MerkleRoot for size", size)
+		}
+	}
+}
+
+// TestVerifySegmentHex checks that proofs can be verified against a hex root,
+// and that malformed roots are reported as errors.
+func TestVerifySegmentHex(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*5 + 2)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 2)
+	ok, err := VerifySegmentHex(base, hashSet, 6, 2, root.String())
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("proof did not verify against the hex root")
+	}
+	ok, err = VerifySegmentHex(base, hashSet, 6, 3, root.String())
+	if err != nil || ok {
+		t.Error("proof verified at the wrong index", err)
+	}
+	if _, err := VerifySegmentHex(base, hashSet, 6, 2, root.String()[1:]); err != ErrHashWrongLen {
+		t.Error("expected ErrHashWrongLen, got", err)
+	}
+	if _, err := VerifySegmentHex(base, hashSet, 6, 2, "zz"+root.String()[2:]); err == nil {
+		t.Error("expected an error for a root that is not hex")
+	}
+}
+
+// TestFoldRoots checks that FoldRoots produces the root of a tree of roots
+// and a valid proof for each of them.
+func TestFoldRoots(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 7, 8, 13} {
+		roots := make([]Hash, n)
+		tree := NewTree()
+		for i := range roots {
+			roots[i] = HashObject(i)
+			tree.Push(roots[i][:])
+		}
+		root, proofs := FoldRoots(roots)
+		if root != tree.Root() {
+			t.Fatal("wrong folded root for", n, "roots")
+		}
+		for i := range roots {
+			if !VerifySegment(roots[i][:], proofs[i], uint64(n), uint64(i), root) {
+				t.Fatalf("proof for root %v of %v did not verify", i, n)
+			}
+		}
+	}
+}
+
+// TestMerkleRootOfHashes checks that sector roots can be committed to and
+// proven with MerkleRootOfHashes and BuildHashProof.
+func TestMerkleRootOfHashes(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*40 + 9)
+	roots, err := SectorRoots(bytes.NewReader(data), SegmentSize*8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := MerkleRootOfHashes(roots)
+	if folded, _ := FoldRoots(roots); root != folded {
+		t.Fatal("MerkleRootOfHashes does not match FoldRoots")
+	}
+	for i := range roots {
+		base, hashSet := BuildHashProof(roots, uint64(i))
+		if !bytes.Equal(base, roots[i][:]) || !VerifySegment(base, hashSet, uint64(len(roots)), uint64(i), root) {
+			t.Fatal("proof for sector root", i, "did not verify")
+		}
+	}
+	if base, _ := BuildHashProof(roots, uint64(len(roots))); base != nil {
+		t.Error("proof built for an index past the end of the roots")
+	}
+	if MerkleRootOfHashes(nil) != EmptyRoot() {
+		t.Error("root of no hashes is not EmptyRoot")
+	}
+}
+
+// TestTruncatedRoot checks that truncated roots match the root of the
+// truncated data.
+func TestTruncatedRoot(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*24 + 9)
+	var subtreeRoots []Hash
+	for i := 0; i < 6; i++ {
+		subtreeRoots = append(subtreeRoots, MerkleRoot(data[i*4*SegmentSize:(i+1)*4*SegmentSize]))
+	}
+	for keep := uint64(0); keep <= 25; keep++ {
+		root, err := TruncatedRoot(bytes.NewReader(data), keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := keep * SegmentSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		if root != MerkleRoot(data[:end]) {
+			t.Fatal("wrong truncated root for", keep, "leaves")
+		}
+
+		subRoot, err := TruncatedRootFromSubtrees(subtreeRoots, 2, keep)
+		if keep%4 != 0 || keep > 24 {
+			if err != ErrInvalidRange {
+				t.Fatal("expected ErrInvalidRange for", keep, "leaves, got", err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else if subRoot != root {
+			t.Fatal("wrong truncated root from subtrees for", keep, "leaves")
+		}
+	}
+
+	// The data holds only 25 leaves.
+	if _, err := TruncatedRoot(bytes.NewReader(data), 26); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if _, err := TruncatedRoot(bytes.NewReader(data), 1<<60); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+}
+
+// TestReaderMerkleRootAndLeaves checks that the number of leaves read is
+// reported along with the root.
+func TestReaderMerkleRootAndLeaves(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize, SegmentSize*9 + 30, SegmentSize * 32} {
+		data := fastrand.Bytes(size)
+		root, numLeaves, err := ReaderMerkleRootAndLeaves(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		} else if root != MerkleRoot(data) {
+			t.Fatal("wrong root for size", size)
+		}
+		expected := CalculateLeaves(uint64(size))
+		if size == 0 {
+			expected = 0
+		}
+		if numLeaves != expected {
+			t.Fatalf("expected %v leaves for size %v, got %v", expected, size, numLeaves)
+		}
+	}
+}
+
+// TestVerifySubtreeRoots checks that a root can be checked against the roots
+// of its subtrees.
+func TestVerifySubtreeRoots(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*21 + 9)
+	fullRoot := MerkleRoot(data)
+	var subtreeRoots []Hash
+	for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+		subtreeRoots = append(subtreeRoots, MerkleRoot(buf.Next(SegmentSize*8)))
+	}
+	if !VerifySubtreeRoots(subtreeRoots, 3, fullRoot) {
+		t.Fatal("subtree roots did not verify")
+	}
+	if VerifySubtreeRoots(subtreeRoots[:2], 3, fullRoot) {
+		t.Error("incomplete subtree roots verified")
+	}
+	subtreeRoots[1][0]++
+	if VerifySubtreeRoots(subtreeRoots, 3, fullRoot) {
+		t.Error("corrupt subtree roots verified")
+	}
+}
+
+// TestEmptyRoot checks the Merkle root of empty data.
+func TestEmptyRoot(t *testing.T) {
+	if EmptyRoot() != (Hash{}) {
+		t.Fatal("EmptyRoot is not the zero hash")
+	}
+	root, err := ReaderMerkleRoot(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	} else if root != EmptyRoot() {
+		t.Fatal("ReaderMerkleRoot of empty data is not EmptyRoot")
+	}
+	if MerkleRoot(nil) != EmptyRoot() || NewTree().Root() != EmptyRoot() {
+		t.Fatal("root of empty data is not EmptyRoot")
+	}
+	if merkletree.New(NewHash()).Root() != nil {
+		t.Fatal("merkletree no longer agrees on the root of empty data")
+	}
+}
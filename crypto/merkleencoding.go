@@ -0,0 +1,273 @@
+package crypto
+
+// merkleencoding.go contains functions for encoding storage proofs so that
+// they can be stored and transmitted between independent implementations.
+//
+// There is no compact form of the encoding. Trees whose leaf count is not a
+// power of two are not padded with zero leaves; the final subtrees are simply
+// smaller. Every hash in a proof is therefore the root of real data, and none
+// can be recomputed by the verifier from a padding convention.
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/NebulousLabs/Sia/encoding"
+)
+
+const (
+	// proofEncodingVersion is the version byte that prefixes every proof
+	// encoded by MarshalProof.
+	proofEncodingVersion = 1
+
+	// fullProofEncodingVersion is the version byte that prefixes every proof
+	// encoded by MarshalProofFull.
+	fullProofEncodingVersion = 3
+
+	// maxStreamProofFrame is the largest frame that ReadStreamProofs will
+	// accept. It is far larger than any proof of a single segment.
+	maxStreamProofFrame = 1 << 20
+)
+
+// An AlgorithmID identifies the hash algorithm used to build a Merkle tree, so
+// that an encoded proof can declare how it should be verified.
+type AlgorithmID byte
+
+const (
+	// AlgorithmBlake2b identifies blake2b-256, the algorithm used by Sia. It
+	// is always registered.
+	AlgorithmBlake2b AlgorithmID = 0
+)
+
+var (
+	// algorithms maps each registered AlgorithmID to a function returning a
+	// new hasher for it.
+	algorithms   = map[AlgorithmID]func() hash.Hash{AlgorithmBlake2b: NewHash}
+	algorithmsMu sync.RWMutex
+)
+
+var (
+	// ErrUnknownAlgorithm is returned when decoding a proof that was built
+	// with an algorithm that has not been registered.
+	ErrUnknownAlgorithm = errors.New("proof uses an unregistered hash algorithm")
+
+	// ErrUnsupportedProofVersion is returned when decoding a proof with an
+	// unknown version byte.
+	ErrUnsupportedProofVersion = errors.New("unsupported proof encoding version")
+
+	// errTrailingProofBytes is returned when an encoded proof is followed by
+	// unexpected data.
+	errTrailingProofBytes = errors.New("encoded proof has trailing bytes")
+)
+
+// MarshalProof encodes a storage proof. The encoding is a single version byte,
+// followed by the base segment as an 8-byte little-endian length and the raw
+// segment, followed by the hash set as an 8-byte little-endian count and each
+// hash in order.
+func MarshalProof(base []byte, hashSet []Hash) []byte {
+	return append([]byte{proofEncodingVersion}, encoding.MarshalAll(base, hashSet)...)
+}
+
+// UnmarshalProof decodes a storage proof encoded by MarshalProof. Truncated
+// input, unknown versions, and trailing bytes are all rejected.
+func UnmarshalProof(b []byte) (base []byte, hashSet []Hash, err error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("encoded proof is empty")
+	} else if b[0] != proofEncodingVersion {
+		return nil, nil, ErrUnsupportedProofVersion
+	}
+	if err := encoding.UnmarshalAll(b[1:], &base, &hashSet); err != nil {
+		return nil, nil, err
+	}
+	// Re-encoding the proof is the simplest way to detect trailing bytes.
+	if len(MarshalProof(base, hashSet)) != len(b) {
+		return nil, nil, errTrailingProofBytes
+	}
+	return base, hashSet, nil
+}
+
+// RegisterAlgorithm makes the hash algorithm returned by 'newHasher' available
+// to VerifyMarshaledProof under 'id'. The hasher must produce HashSize-byte
+// digests. Registering an ID twice, or registering a nil function, panics.
+func RegisterAlgorithm(id AlgorithmID, newHasher func() hash.Hash) {
+	if newHasher == nil {
+		panic("RegisterAlgorithm called with a nil hasher")
+	} else if newHasher().Size() != HashSize {
+		panic(ErrHashWrongLen)
+	}
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+	if _, ok := algorithms[id]; ok {
+		panic("RegisterAlgorithm called twice for the same algorithm")
+	}
+	algorithms[id] = newHasher
+}
+
+// MarshalProofFull encodes a storage proof along with the number of leaves in
+// the tree and the index of the proven segment, so that the proof can be
+// verified without any other metadata. The proof is marked as using
+// AlgorithmBlake2b.
+func MarshalProofFull(base []byte, hashSet []Hash, numLeaves, index uint64) []byte {
+	return MarshalProofFullAlgorithm(AlgorithmBlake2b, base, hashSet, numLeaves, index)
+}
+
+// MarshalProofFullAlgorithm is the same as MarshalProofFull, but marks the
+// proof as using the algorithm 'id'. The encoding is a single version byte and
+// the algorithm ID, followed by the number of leaves and the index as 8-byte
+// little-endian integers, followed by the base segment and hash set encoded as
+// in MarshalProof. UnmarshalProof does not accept the full encoding.
+func MarshalProofFullAlgorithm(id AlgorithmID, base []byte, hashSet []Hash, numLeaves, index uint64) []byte {
+	return append([]byte{fullProofEncodingVersion, byte(id)}, encoding.MarshalAll(numLeaves, index, base, hashSet)...)
+}
+
+// VerifyMarshaledProof decodes a storage proof encoded by MarshalProofFull and
+// reports whether it proves a segment of the tree with Merkle root 'root',
+// using the algorithm the proof declares. An error is returned only if the
+// proof cannot be decoded, or if its algorithm has not been registered.
+func VerifyMarshaledProof(data []byte, root Hash) (bool, error) {
+	if len(data) == 0 {
+		return false, errors.New("encoded proof is empty")
+	} else if data[0] != fullProofEncodingVersion {
+		return false, ErrUnsupportedProofVersion
+	} else if len(data) < 2 {
+		return false, errors.New("encoded proof is missing its algorithm")
+	}
+	id := AlgorithmID(data[1])
+	algorithmsMu.RLock()
+	newHasher, ok := algorithms[id]
+	algorithmsMu.RUnlock()
+	if !ok {
+		return false, ErrUnknownAlgorithm
+	}
+
+	var numLeaves, index uint64
+	var base []byte
+	var hashSet []Hash
+	if err := encoding.UnmarshalAll(data[2:], &numLeaves, &index, &base, &hashSet); err != nil {
+		return false, err
+	}
+	if len(MarshalProofFullAlgorithm(id, base, hashSet, numLeaves, index)) != len(data) {
+		return false, errTrailingProofBytes
+	}
+	pv := NewProofVerifier(numLeaves, index, root)
+	if id != AlgorithmBlake2b {
+		pv.hasher = newHasher()
+	}
+	if pv.WriteSegment(base) != nil {
+		return false, nil
+	}
+	for _, h := range hashSet {
+		if pv.WriteProofHash(h) != nil {
+			return false, nil
+		}
+	}
+	return pv.Verify(), nil
+}
+
+// WriteStreamProofs writes 'proofs' to 'w' as a series of frames, one per
+// proof. Each frame is an 8-byte little-endian length followed by the proof,
+// encoded with the encoding package, so that each base segment arrives
+// alongside its proof hashes.
+func WriteStreamProofs(w io.Writer, proofs []SegmentProof) error {
+	for _, sp := range proofs {
+		if err := encoding.WriteObject(w, sp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadStreamProofs reads the frames written by WriteStreamProofs until 'r' is
+// exhausted. Each frame is read and decoded before the next, so no more than
+// one frame is buffered at a time. A frame that is truncated, too large, or
+// cannot be decoded produces an error naming the frame.
+func ReadStreamProofs(r io.Reader) ([]SegmentProof, error) {
+	var proofs []SegmentProof
+	prefix := make([]byte, 8)
+	for {
+		// The stream may only end between frames.
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return proofs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("malformed proof frame %v: %v", len(proofs), err)
+		}
+		frameLen := encoding.DecUint64(prefix)
+		if frameLen > maxStreamProofFrame {
+			return nil, fmt.Errorf("malformed proof frame %v: length %v exceeds maximum of %v", len(proofs), frameLen, maxStreamProofFrame)
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(r, frame); err == io.EOF {
+			return nil, fmt.Errorf("malformed proof frame %v: %v", len(proofs), io.ErrUnexpectedEOF)
+		} else if err != nil {
+			return nil, fmt.Errorf("malformed proof frame %v: %v", len(proofs), err)
+		}
+		var sp SegmentProof
+		if err := encoding.Unmarshal(frame, &sp); err != nil {
+			return nil, fmt.Errorf("malformed proof frame %v: %v", len(proofs), err)
+		}
+		proofs = append(proofs, sp)
+	}
+}
+
+// A StorageProof is a storage proof along with the number of leaves in the
+// tree and the index of the proven segment. Its JSON form holds the base
+// segment as standard base64 and each hash of the hash set as hex.
+type StorageProof struct {
+	Base      []byte
+	HashSet   []Hash
+	NumLeaves uint64
+	Index     uint64
+}
+
+// storageProofJSON is the JSON form of a StorageProof.
+type storageProofJSON struct {
+	Base      string   `json:"base"`
+	HashSet   []string `json:"hashset"`
+	NumLeaves uint64   `json:"numleaves"`
+	Index     uint64   `json:"index"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (sp StorageProof) MarshalJSON() ([]byte, error) {
+	spj := storageProofJSON{
+		Base:      base64.StdEncoding.EncodeToString(sp.Base),
+		HashSet:   make([]string, len(sp.HashSet)),
+		NumLeaves: sp.NumLeaves,
+		Index:     sp.Index,
+	}
+	for i, h := range sp.HashSet {
+		spj.HashSet[i] = h.String()
+	}
+	return json.Marshal(spj)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The error names the field that
+// could not be decoded.
+func (sp *StorageProof) UnmarshalJSON(b []byte) error {
+	var spj storageProofJSON
+	if err := json.Unmarshal(b, &spj); err != nil {
+		return err
+	}
+	base, err := base64.StdEncoding.DecodeString(spj.Base)
+	if err != nil {
+		return fmt.Errorf("could not decode base segment of storage proof: %v", err)
+	}
+	hashSet := make([]Hash, len(spj.HashSet))
+	for i, s := range spj.HashSet {
+		if err := hashSet[i].LoadString(s); err != nil {
+			return fmt.Errorf("could not decode hash %v of storage proof: %v", i, err)
+		}
+	}
+	*sp = StorageProof{
+		Base:      base,
+		HashSet:   hashSet,
+		NumLeaves: spj.NumLeaves,
+		Index:     spj.Index,
+	}
+	return nil
+}
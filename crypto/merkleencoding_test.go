@@ -0,0 +1,235 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestMarshalProof checks that a storage proof survives a round trip through
+// MarshalProof and UnmarshalProof, and that malformed encodings are rejected.
+func TestMarshalProof(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*11 + 7)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 10)
+
+	b := MarshalProof(base, hashSet)
+	if len(b) != 1+8+len(base)+8+HashSize*len(hashSet) {
+		t.Fatal("encoded proof has the wrong length:", len(b))
+	}
+	decodedBase, decodedHashSet, err := UnmarshalProof(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedBase, base) || len(decodedHashSet) != len(hashSet) {
+		t.Fatal("decoded proof does not match the original")
+	}
+	if !VerifySegment(decodedBase, decodedHashSet, 12, 10, root) {
+		t.Fatal("decoded proof does not verify")
+	}
+
+	// Every truncation of the encoding should be rejected.
+	for i := 0; i < len(b); i++ {
+		if _, _, err := UnmarshalProof(b[:i]); err == nil {
+			t.Fatal("truncated proof of length", i, "was accepted")
+		}
+	}
+
+	// A hash set entry with the wrong length shows up as trailing bytes.
+	if _, _, err := UnmarshalProof(append(b, 0)); err != errTrailingProofBytes {
+		t.Error("expected errTrailingProofBytes, got", err)
+	}
+
+	// An unknown version should be rejected.
+	b[0] = proofEncodingVersion + 1
+	if _, _, err := UnmarshalProof(b); err != ErrUnsupportedProofVersion {
+		t.Error("expected ErrUnsupportedProofVersion, got", err)
+	}
+}
+
+// TestMarshalProofFull checks that a fully encoded proof verifies without any
+// other metadata, and that malformed encodings are rejected.
+func TestMarshalProofFull(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*11 + 7)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 10)
+
+	b := MarshalProofFull(base, hashSet, 12, 10)
+	if len(b) != 2+8+8+8+len(base)+8+HashSize*len(hashSet) {
+		t.Fatal("encoded proof has the wrong length:", len(b))
+	}
+	if ok, err := VerifyMarshaledProof(b, root); err != nil || !ok {
+		t.Fatal("encoded proof did not verify:", err)
+	}
+	if ok, err := VerifyMarshaledProof(b, HashBytes(data)); err != nil || ok {
+		t.Fatal("encoded proof verified against the wrong root:", err)
+	}
+	if ok, err := VerifyMarshaledProof(MarshalProofFull(base, hashSet, 12, 9), root); err != nil || ok {
+		t.Fatal("encoded proof verified with the wrong index:", err)
+	}
+
+	// Every truncation of the encoding should be rejected.
+	for i := 0; i < len(b); i++ {
+		if _, err := VerifyMarshaledProof(b[:i], root); err == nil {
+			t.Fatal("truncated proof of length", i, "was accepted")
+		}
+	}
+	if _, err := VerifyMarshaledProof(append(b, 0), root); err != errTrailingProofBytes {
+		t.Error("expected errTrailingProofBytes, got", err)
+	}
+
+	// The two encodings should not be confused with each other.
+	if _, err := VerifyMarshaledProof(MarshalProof(base, hashSet), root); err != ErrUnsupportedProofVersion {
+		t.Error("expected ErrUnsupportedProofVersion, got", err)
+	}
+	if _, _, err := UnmarshalProof(b); err != ErrUnsupportedProofVersion {
+		t.Error("expected ErrUnsupportedProofVersion, got", err)
+	}
+
+	// The version 2 layout, which has no algorithm byte, should be rejected.
+	legacy := append([]byte{2}, encoding.MarshalAll(uint64(12), uint64(10), base, hashSet)...)
+	if _, err := VerifyMarshaledProof(legacy, root); err != ErrUnsupportedProofVersion {
+		t.Error("expected ErrUnsupportedProofVersion, got", err)
+	}
+}
+
+// registerTestAlgorithm registers sha256 as testAlgorithm, once per test
+// binary.
+var registerTestAlgorithm sync.Once
+
+// testAlgorithm is the AlgorithmID used for sha256 in tests.
+const testAlgorithm AlgorithmID = 0xff
+
+// TestRegisterAlgorithm checks that VerifyMarshaledProof uses the algorithm a
+// proof declares, and rejects unregistered algorithms.
+func TestRegisterAlgorithm(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*9 + 20)
+	tree := NewTreeHasher(sha256.New())
+	tree.SetIndex(6)
+	for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+		tree.Push(buf.Next(SegmentSize))
+	}
+	root := tree.Root()
+	base, hashSet := tree.ProveHashSet()
+
+	b := MarshalProofFullAlgorithm(testAlgorithm, base, hashSet, 10, 6)
+	registerTestAlgorithm.Do(func() {
+		if _, err := VerifyMarshaledProof(b, root); err != ErrUnknownAlgorithm {
+			t.Error("expected ErrUnknownAlgorithm, got", err)
+		}
+		RegisterAlgorithm(testAlgorithm, sha256.New)
+	})
+	if ok, err := VerifyMarshaledProof(b, root); err != nil || !ok {
+		t.Fatal("sha256 proof did not verify:", err)
+	}
+
+	// The same proof marked as blake2b should not verify.
+	if ok, err := VerifyMarshaledProof(MarshalProofFull(base, hashSet, 10, 6), root); err != nil || ok {
+		t.Fatal("sha256 proof verified as blake2b:", err)
+	}
+
+	// Registering an algorithm twice should panic.
+	defer func() {
+		if recover() == nil {
+			t.Error("registering blake2b again did not panic")
+		}
+	}()
+	RegisterAlgorithm(AlgorithmBlake2b, NewHash)
+}
+
+// TestStreamProofs checks that proofs survive a round trip through
+// WriteStreamProofs and ReadStreamProofs, and that truncated streams are
+// rejected.
+func TestStreamProofs(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*20 + 9)
+	root := MerkleRoot(data)
+	var proofs []SegmentProof
+	for _, index := range []uint64{0, 7, 20} {
+		base, hashSet := MerkleProof(data, index)
+		proofs = append(proofs, SegmentProof{
+			Base:      base,
+			HashSet:   hashSet,
+			NumLeaves: 21,
+			Index:     index,
+			Root:      root,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := WriteStreamProofs(&buf, proofs); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	read, err := ReadStreamProofs(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(read) != len(proofs) {
+		t.Fatal("wrong number of proofs read:", len(read))
+	}
+	for i, ok := range VerifyBatch(read) {
+		if !ok || read[i].Index != proofs[i].Index {
+			t.Fatal("proof read from the stream did not verify:", i)
+		}
+	}
+
+	// An empty stream holds no proofs.
+	if read, err := ReadStreamProofs(bytes.NewReader(nil)); err != nil || len(read) != 0 {
+		t.Error("empty stream should hold no proofs:", err)
+	}
+
+	// A stream cut off partway through a frame should be rejected.
+	for _, n := range []int{1, 8, 20, len(stream) - 1} {
+		if _, err := ReadStreamProofs(bytes.NewReader(stream[:n])); err == nil {
+			t.Error("truncated stream of length", n, "was accepted")
+		}
+	}
+
+	// An oversized frame should be rejected without being read.
+	if _, err := ReadStreamProofs(bytes.NewReader(encoding.EncUint64(maxStreamProofFrame + 1))); err == nil {
+		t.Error("oversized frame was accepted")
+	}
+}
+
+// TestStorageProofJSON checks that a StorageProof survives a round trip
+// through JSON, and that malformed fields are rejected.
+func TestStorageProofJSON(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*5 + 3)
+	base, hashSet := MerkleProof(data, 5)
+	sp := StorageProof{Base: base, HashSet: hashSet, NumLeaves: 6, Index: 5}
+	b, err := json.Marshal(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded StorageProof
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Base, sp.Base) || len(decoded.HashSet) != len(sp.HashSet) || decoded.NumLeaves != 6 || decoded.Index != 5 {
+		t.Fatal("decoded proof does not match the original")
+	}
+	for i := range hashSet {
+		if decoded.HashSet[i] != hashSet[i] {
+			t.Fatal("decoded hash set does not match the original")
+		}
+	}
+	if !VerifySegment(decoded.Base, decoded.HashSet, decoded.NumLeaves, decoded.Index, MerkleRoot(data)) {
+		t.Fatal("decoded proof did not verify")
+	}
+
+	for _, bad := range []string{
+		`{"base":"not base64!","hashset":[],"numleaves":1,"index":0}`,
+		`{"base":"","hashset":["zz"],"numleaves":1,"index":0}`,
+		`{"base":"","hashset":["` + strings.Repeat("g", HashSize*2) + `"],"numleaves":1,"index":0}`,
+		`{"base":"","hashset":"","numleaves":1,"index":0}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &decoded); err == nil {
+			t.Error("malformed proof was accepted:", bad)
+		}
+	}
+}
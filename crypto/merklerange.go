@@ -0,0 +1,499 @@
+package crypto
+
+// merklerange.go contains functions for building and verifying Merkle proofs
+// that cover more than one segment. Both range proofs and multi-proofs consist
+// of the roots of the largest aligned subtrees that do not contain any of the
+// proven segments, in left-to-right order. For a range proof, only the
+// subtrees along the boundaries of the range are included, so a range proof
+// contains O(log n) hashes regardless of the size of the range. For a
+// multi-proof, sibling hashes shared between several indices appear only once.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// indexSlice implements sort.Interface, allowing leaf indices to be sorted.
+type indexSlice []uint64
+
+func (is indexSlice) Len() int           { return len(is) }
+func (is indexSlice) Less(i, j int) bool { return is[i] < is[j] }
+func (is indexSlice) Swap(i, j int)      { is[i], is[j] = is[j], is[i] }
+
+// sortedIndices returns a sorted copy of 'indices' with duplicates removed.
+func sortedIndices(indices []uint64) []uint64 {
+	sorted := append(indexSlice(nil), indices...)
+	sort.Sort(sorted)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1] {
+			sorted = append(sorted[:i], sorted[i+1:]...)
+			i--
+		}
+	}
+	return sorted
+}
+
+// NormalizeIndices returns a sorted copy of 'indices' with duplicates
+// removed, as used by multi-proofs. If any index is not less than 'numLeaves',
+// ErrIndexOutOfRange is returned.
+func NormalizeIndices(indices []uint64, numLeaves uint64) ([]uint64, error) {
+	sorted := sortedIndices(indices)
+	if len(sorted) > 0 && sorted[len(sorted)-1] >= numLeaves {
+		return nil, ErrIndexOutOfRange
+	}
+	return sorted, nil
+}
+
+// pushProofSubtrees pushes the subtrees covering the leaves in [from, to) onto
+// 's', taking their roots from the front of 'proofSet'. false is returned if
+// 'proofSet' runs out of hashes.
+func pushProofSubtrees(s *subtreeStack, proofSet *[]Hash, from, to uint64) bool {
+	for from < to {
+		if len(*proofSet) == 0 {
+			return false
+		}
+		height := nextSubtreeHeight(from, to)
+		s.push(subtree{index: from, height: height, sum: (*proofSet)[0]})
+		*proofSet = (*proofSet)[1:]
+		from += 1 << height
+	}
+	return true
+}
+
+// numProofSubtrees returns the number of subtrees that pushProofSubtrees
+// consumes to cover the leaves in [from, to).
+func numProofSubtrees(from, to uint64) (n int) {
+	for from < to {
+		from += 1 << nextSubtreeHeight(from, to)
+		n++
+	}
+	return n
+}
+
+// BuildReaderRangeProof builds a Merkle proof that the segments in the range
+// [start, end) are a part of the Merkle root formed by the data in 'r'. The
+// reader is consumed exactly once.
+func BuildReaderRangeProof(r io.Reader, start, end uint64) (proofSet []Hash, err error) {
+	if start >= end {
+		return nil, ErrInvalidRange
+	}
+
+	// Leaves to the left of the range are pushed into one stack, and leaves
+	// to the right of the range are pushed into another. Because the stacks
+	// only join aligned subtrees, each stack will contain exactly the subtrees
+	// that the verifier expects once the reader is exhausted.
+	var left, right subtreeStack
+	var index uint64
+	numSegments, err := readSegments(r, func(segment []byte) {
+		if index < start {
+			left.push(subtree{index: index, sum: leafSum(segment)})
+		} else if index >= end {
+			right.push(subtree{index: index, sum: leafSum(segment)})
+		}
+		index++
+	})
+	if err != nil {
+		return nil, err
+	}
+	if end > numSegments {
+		return nil, ErrInvalidRange
+	}
+
+	proofSet = make([]Hash, 0, len(left)+len(right))
+	for _, st := range left {
+		proofSet = append(proofSet, st.sum)
+	}
+	for _, st := range right {
+		proofSet = append(proofSet, st.sum)
+	}
+	return proofSet, nil
+}
+
+// RangeProofSize returns the number of hashes in the proof set that
+// BuildReaderRangeProof returns for the range [start, end) of a tree with
+// 'numLeaves' leaves. If the range is invalid, 0 is returned.
+func RangeProofSize(numLeaves, start, end uint64) int {
+	if start >= end || end > numLeaves {
+		return 0
+	}
+	return numProofSubtrees(0, start) + numProofSubtrees(end, numLeaves)
+}
+
+// VerifyRangeProof verifies that 'data' is the content of the segments in the
+// range [start, end) of a Merkle tree with 'numLeaves' leaves and root
+// 'root'. If the range includes the final leaf, the final segment of 'data'
+// may be shorter than SegmentSize.
+func VerifyRangeProof(data []byte, proofSet []Hash, numLeaves, start, end uint64, root Hash) bool {
+	if start >= end || end > numLeaves {
+		return false
+	}
+
+	// Check that 'data' has the right number of bytes for the range. Only the
+	// final leaf of the tree is allowed to be short.
+	numSegments := end - start
+	if end == numLeaves {
+		if uint64(len(data)) <= (numSegments-1)*SegmentSize || uint64(len(data)) > numSegments*SegmentSize {
+			return false
+		}
+	} else if uint64(len(data)) != numSegments*SegmentSize {
+		return false
+	}
+
+	// Rebuild the tree from the left subtrees, the range, and the right
+	// subtrees.
+	var s subtreeStack
+	if !pushProofSubtrees(&s, &proofSet, 0, start) {
+		return false
+	}
+	buf := bytes.NewBuffer(data)
+	for i := start; i < end; i++ {
+		s.push(subtree{index: i, sum: leafSum(buf.Next(SegmentSize))})
+	}
+	if !pushProofSubtrees(&s, &proofSet, end, numLeaves) {
+		return false
+	}
+	if len(proofSet) != 0 {
+		return false
+	}
+	return rootsEqual(s.root(), root)
+}
+
+// blockHeight returns the height of the subtree whose leaves are exactly the
+// range [start, end) of a tree with 'numLeaves' leaves. Such a subtree exists
+// only if 'start' is a multiple of the smallest power of two that is at least
+// end-start, and the range is either that large or runs to the end of the
+// tree. If it does not exist, false is returned.
+func blockHeight(numLeaves, start, end uint64) (uint64, bool) {
+	if start >= end || end > numLeaves {
+		return 0, false
+	}
+	height := uint64(0)
+	for end-start > 1<<height {
+		height++
+	}
+	if start%(1<<height) != 0 || (end-start != 1<<height && end != numLeaves) {
+		return 0, false
+	}
+	return height, true
+}
+
+// BuildBlockProof returns the Merkle root of the segments in the range
+// [start, end) of the first 'size' bytes of 'r', along with a proof that the
+// root is part of the Merkle root of all the data. The proof is the same as a
+// range proof for [start, end), so the block itself can be sent separately
+// and hashed with MerkleRoot by the recipient. The range must cover exactly
+// one subtree of the tree: 'start' must be a multiple of the smallest power of
+// two that is at least end-start, and the range must be that large unless it
+// runs to the end of the data. Otherwise ErrInvalidRange is returned.
+func BuildBlockProof(r io.ReaderAt, size int64, start, end uint64) (blockRoot Hash, blockProof []Hash, err error) {
+	var numLeaves uint64
+	if size > 0 {
+		numLeaves = CalculateLeaves(uint64(size))
+	}
+	if _, ok := blockHeight(numLeaves, start, end); !ok {
+		return Hash{}, nil, ErrInvalidRange
+	}
+	blockStart, blockEnd := int64(start*SegmentSize), int64(end*SegmentSize)
+	if blockEnd > size {
+		blockEnd = size
+	}
+	blockRoot, err = ReaderMerkleRoot(io.NewSectionReader(r, blockStart, blockEnd-blockStart))
+	if err != nil {
+		return Hash{}, nil, err
+	}
+	blockProof, err = BuildReaderRangeProof(io.NewSectionReader(r, 0, size), start, end)
+	if err != nil {
+		return Hash{}, nil, err
+	}
+	return blockRoot, blockProof, nil
+}
+
+// VerifyBlockProof verifies that 'blockRoot' is the Merkle root of the
+// segments in the range [start, end) of a tree with 'numLeaves' leaves and root
+// 'root', given a proof built by BuildBlockProof.
+func VerifyBlockProof(blockRoot Hash, blockProof []Hash, numLeaves, start, end uint64, root Hash) bool {
+	height, ok := blockHeight(numLeaves, start, end)
+	if !ok {
+		return false
+	}
+	var s subtreeStack
+	if !pushProofSubtrees(&s, &blockProof, 0, start) {
+		return false
+	}
+	if end-start == 1<<height {
+		s.push(subtree{index: start, height: height, sum: blockRoot})
+	} else {
+		// A partial block is the last subtree in the tree, and cannot be
+		// joined with the subtree to its left.
+		s = append(s, subtree{index: start, height: height, sum: blockRoot})
+	}
+	if !pushProofSubtrees(&s, &blockProof, end, numLeaves) {
+		return false
+	}
+	if len(blockProof) != 0 {
+		return false
+	}
+	return rootsEqual(s.root(), root)
+}
+
+// BuildReaderMultiProof builds a single Merkle proof that the segments at each
+// of 'indices' are a part of the Merkle root formed by the data in 'r'. The
+// indices may be supplied in any order, and the returned segments are ordered
+// by ascending index. The reader is consumed exactly once.
+func BuildReaderMultiProof(r io.Reader, indices []uint64) (segments [][]byte, proofSet []Hash, err error) {
+	sorted := sortedIndices(indices)
+	if len(sorted) == 0 {
+		return nil, nil, ErrInvalidRange
+	}
+
+	// Leaves between the proven indices are pushed into a stack, which is
+	// flushed to the proof set every time a proven index is reached.
+	var gap subtreeStack
+	flush := func() {
+		for _, st := range gap {
+			proofSet = append(proofSet, st.sum)
+		}
+		gap = gap[:0]
+	}
+	var index uint64
+	remaining := sorted
+	numSegments, err := readSegments(r, func(segment []byte) {
+		if len(remaining) > 0 && remaining[0] == index {
+			flush()
+			segments = append(segments, append([]byte(nil), segment...))
+			remaining = remaining[1:]
+		} else {
+			gap.push(subtree{index: index, sum: leafSum(segment)})
+		}
+		index++
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if sorted[len(sorted)-1] >= numSegments {
+		return nil, nil, ErrInvalidRange
+	}
+	flush()
+	return segments, proofSet, nil
+}
+
+// VerifyMultiProof verifies a proof produced by BuildReaderMultiProof. The
+// segments must be ordered by ascending index. Only the final leaf of the tree
+// may be shorter than SegmentSize. False is returned if any of the segments
+// fails to verify, so a host can use VerifyMultiProof to check its response to
+// a multi-index audit before sending it.
+func VerifyMultiProof(segments [][]byte, proofSet []Hash, numLeaves uint64, indices []uint64, root Hash) bool {
+	sorted, err := NormalizeIndices(indices, numLeaves)
+	if err != nil || len(sorted) == 0 || len(segments) != len(sorted) {
+		return false
+	}
+
+	var s subtreeStack
+	var next uint64
+	for i, index := range sorted {
+		segment := segments[i]
+		if len(segment) > SegmentSize || (len(segment) < SegmentSize && index != numLeaves-1) {
+			return false
+		}
+		if !pushProofSubtrees(&s, &proofSet, next, index) {
+			return false
+		}
+		s.push(subtree{index: index, sum: leafSum(segment)})
+		next = index + 1
+	}
+	if !pushProofSubtrees(&s, &proofSet, next, numLeaves) {
+		return false
+	}
+	if len(proofSet) != 0 {
+		return false
+	}
+	return rootsEqual(s.root(), root)
+}
+
+// BuildAdjacentProof builds a single proof that the segments at 'index' and
+// index+1 are adjacent segments of the Merkle root formed by the data in 'r'.
+// It is a multi-proof of the two indices, so the siblings above the pair
+// appear only once, and the proof is smaller than two separate proofs. If
+// index+1 is not a segment of the data, ErrInvalidRange is returned.
+func BuildAdjacentProof(r io.Reader, index uint64) (segA, segB []byte, proof []Hash, err error) {
+	if index+1 == 0 {
+		return nil, nil, nil, ErrInvalidRange
+	}
+	segments, proof, err := BuildReaderMultiProof(r, []uint64{index, index + 1})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return segments[0], segments[1], proof, nil
+}
+
+// VerifyAdjacentProof verifies a proof produced by BuildAdjacentProof, that
+// 'segA' and 'segB' are the segments at 'index' and index+1 of a tree with
+// 'numLeaves' leaves and the Merkle root 'root'.
+func VerifyAdjacentProof(segA, segB []byte, proof []Hash, numLeaves, index uint64, root Hash) bool {
+	if index+1 == 0 {
+		return false
+	}
+	return VerifyMultiProof([][]byte{segA, segB}, proof, numLeaves, []uint64{index, index + 1}, root)
+}
+
+// BuildTailProof builds a storage proof for each of the final 'lastN' segments
+// of the first 'size' bytes of 'r'. The proofs are returned in leaf order and
+// can be checked with VerifySegment. 'subtreeRoots' are the roots of the
+// subtrees of height 'subtreeHeight' that make up the data, as pushed to a
+// CachedMerkleTree. The data covered by the full subtrees before the tail is
+// not read: only the segments from the start of the subtree that holds the
+// first tail segment onward are read from 'r', in large blocks. If 'lastN' is
+// zero or larger than the number of segments, or 'subtreeRoots' does not
+// cover the data before the tail, ErrInvalidRange is returned, and if 'r'
+// holds fewer than 'size' bytes, io.ErrUnexpectedEOF is returned.
+func BuildTailProof(r io.ReaderAt, size int64, lastN uint64, subtreeRoots []Hash, subtreeHeight uint64) ([]SegmentProof, error) {
+	var numLeaves uint64
+	if size > 0 {
+		numLeaves = CalculateLeaves(uint64(size))
+	}
+	if lastN == 0 || lastN > numLeaves || subtreeHeight >= 64 {
+		return nil, ErrInvalidRange
+	}
+	start := numLeaves - lastN
+	cached := start >> subtreeHeight
+	if cached > uint64(len(subtreeRoots)) {
+		return nil, ErrInvalidRange
+	}
+	proofs := make([]SegmentProof, lastN)
+
+	// The cached subtrees stand in for the leaves before the tail. Any of
+	// them may be the sibling of a tail segment, and none contain one.
+	var s subtreeStack
+	for i, h := range subtreeRoots[:cached] {
+		s.push(subtree{index: uint64(i) << subtreeHeight, height: subtreeHeight, sum: h})
+	}
+	index := cached << subtreeHeight
+	offset := int64(index) * SegmentSize
+
+	// tailProofs returns the proofs of the tail segments covered by 'st'.
+	tailProofs := func(st subtree) []SegmentProof {
+		end := st.index + 1<<st.height
+		if end <= start {
+			return nil
+		} else if st.index <= start {
+			return proofs[:end-start]
+		}
+		return proofs[st.index-start : end-start]
+	}
+
+	// Whenever two subtrees are joined, each is the sibling of every tail
+	// segment in the other.
+	_, err := readSegmentsAt(io.NewSectionReader(r, offset, size-offset), size-offset, func(segment []byte) {
+		if index >= start {
+			proofs[index-start].Base = append([]byte(nil), segment...)
+		}
+		s.pushWith(subtree{index: index, sum: leafSum(segment)}, nil, func(left, right subtree) {
+			leftTail, rightTail := tailProofs(left), tailProofs(right)
+			for i := range leftTail {
+				leftTail[i].HashSet = append(leftTail[i].HashSet, right.sum)
+			}
+			for i := range rightTail {
+				rightTail[i].HashSet = append(rightTail[i].HashSet, left.sum)
+			}
+		})
+		index++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each proof ends with the root of everything to the right of the
+	// segment's perfect subtree, then each subtree to its left, nearest
+	// first.
+	root := s.root()
+	for k, st := range s {
+		var right Hash
+		if k+1 < len(s) {
+			right = s[k+1:].root()
+		}
+		tail := tailProofs(st)
+		for i := range tail {
+			if k+1 < len(s) {
+				tail[i].HashSet = append(tail[i].HashSet, right)
+			}
+			for j := k - 1; j >= 0; j-- {
+				tail[i].HashSet = append(tail[i].HashSet, s[j].sum)
+			}
+		}
+	}
+	for i := range proofs {
+		proofs[i].NumLeaves = numLeaves
+		proofs[i].Index = start + uint64(i)
+		proofs[i].Root = root
+	}
+	return proofs, nil
+}
+
+// ProofCoverage checks that 'proofSet' has exactly the number of hashes that
+// a multi-proof for 'indices' in a tree of 'numLeaves' leaves requires, and
+// returns the leaf indices the proof covers, sorted and without duplicates. It
+// does not check the hashes against a root; use VerifyMultiProof for that.
+func ProofCoverage(proofSet []Hash, numLeaves uint64, indices []uint64) (covered []uint64, err error) {
+	covered, err = NormalizeIndices(indices, numLeaves)
+	if err != nil {
+		return nil, err
+	} else if len(covered) == 0 {
+		return nil, ErrInvalidRange
+	}
+	var size int
+	var next uint64
+	for _, index := range covered {
+		size += numProofSubtrees(next, index)
+		next = index + 1
+	}
+	size += numProofSubtrees(next, numLeaves)
+	if len(proofSet) != size {
+		return nil, ErrProofWrongLength
+	}
+	return covered, nil
+}
+
+// ChallengeIndices deterministically derives 'count' distinct leaf indices in
+// [0, numLeaves) from 'seed', so that a prover and verifier who share the seed
+// agree on which segments to prove. If 'count' is larger than 'numLeaves',
+// every index is returned. The indices are derived with HashAll and are the
+// same on every platform.
+func ChallengeIndices(seed Hash, numLeaves uint64, count int) []uint64 {
+	if count <= 0 || numLeaves == 0 {
+		return nil
+	}
+	if uint64(count) > numLeaves {
+		count = int(numLeaves)
+	}
+
+	// Perform the first 'count' steps of a Fisher-Yates shuffle of
+	// [0, numLeaves). Only swapped positions are stored.
+	var counter uint64
+	random := func(n uint64) uint64 {
+		// Reject values that would bias the result towards small indices.
+		limit := ^uint64(0) - ^uint64(0)%n
+		for {
+			h := HashAll(seed, counter)
+			counter++
+			if v := binary.LittleEndian.Uint64(h[:8]); v < limit {
+				return v % n
+			}
+		}
+	}
+	swapped := make(map[uint64]uint64)
+	at := func(i uint64) uint64 {
+		if v, ok := swapped[i]; ok {
+			return v
+		}
+		return i
+	}
+	indices := make([]uint64, count)
+	for i := range indices {
+		j := uint64(i) + random(numLeaves-uint64(i))
+		indices[i] = at(j)
+		swapped[j] = at(uint64(i))
+	}
+	return indices
+}
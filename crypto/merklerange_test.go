@@ -0,0 +1,468 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestRangeProof builds and verifies range proofs for every range of several
+// trees, including trees whose final leaf is shorter than SegmentSize.
+func TestRangeProof(t *testing.T) {
+	for _, size := range []int{1, SegmentSize, SegmentSize*7 + 10, SegmentSize * 8, SegmentSize*13 + 1} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		numLeaves := CalculateLeaves(uint64(size))
+		for start := uint64(0); start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				proofSet, err := BuildReaderRangeProof(bytes.NewReader(data), start, end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rangeData := data[start*SegmentSize:]
+				if end*SegmentSize < uint64(len(data)) {
+					rangeData = data[start*SegmentSize : end*SegmentSize]
+				}
+				if !VerifyRangeProof(rangeData, proofSet, numLeaves, start, end, root) {
+					t.Fatalf("range proof [%v, %v) over %v leaves did not verify", start, end, numLeaves)
+				}
+			}
+		}
+	}
+}
+
+// TestRangeProofSize checks that a range proof only contains the hashes along
+// the boundaries of the range.
+func TestRangeProofSize(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize * 1024)
+	proofSet, err := BuildReaderRangeProof(bytes.NewReader(data), 3, 1003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The left side is {0-1, 2} and the right side is {1003, 1004-1007,
+	// 1008-1023}.
+	if len(proofSet) != 5 {
+		t.Fatal("range proof has the wrong number of hashes:", len(proofSet))
+	}
+	if !VerifyRangeProof(data[3*SegmentSize:1003*SegmentSize], proofSet, 1024, 3, 1003, MerkleRoot(data)) {
+		t.Fatal("range proof did not verify")
+	}
+}
+
+// TestRangeProofSizeEstimate checks that RangeProofSize matches the length of
+// the proofs built by BuildReaderRangeProof.
+func TestRangeProofSizeEstimate(t *testing.T) {
+	for _, size := range []int{1, SegmentSize*7 + 10, SegmentSize * 8, SegmentSize*13 + 1} {
+		data := fastrand.Bytes(size)
+		numLeaves := CalculateLeaves(uint64(size))
+		for start := uint64(0); start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				proofSet, err := BuildReaderRangeProof(bytes.NewReader(data), start, end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if RangeProofSize(numLeaves, start, end) != len(proofSet) {
+					t.Fatalf("RangeProofSize(%v, %v, %v) = %v, expected %v", numLeaves, start, end, RangeProofSize(numLeaves, start, end), len(proofSet))
+				}
+			}
+		}
+	}
+	if RangeProofSize(10, 5, 5) != 0 || RangeProofSize(10, 5, 11) != 0 {
+		t.Error("expected 0 for an invalid range")
+	}
+}
+
+// TestBadRangeProof checks that invalid range proofs are rejected.
+func TestBadRangeProof(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*9 + 20)
+	root := MerkleRoot(data)
+	rangeData := data[2*SegmentSize : 5*SegmentSize]
+	proofSet, err := BuildReaderRangeProof(bytes.NewReader(data), 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid ranges should not be buildable.
+	if _, err := BuildReaderRangeProof(bytes.NewReader(data), 5, 5); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+	if _, err := BuildReaderRangeProof(bytes.NewReader(data), 5, 11); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+
+	// Try verifying with the wrong range, root, data, and proof.
+	if VerifyRangeProof(rangeData, proofSet, 10, 3, 6, root) {
+		t.Error("verified a proof for the wrong range")
+	}
+	if VerifyRangeProof(rangeData, proofSet, 10, 2, 5, HashBytes(data)) {
+		t.Error("verified a proof against the wrong root")
+	}
+	badData := append([]byte(nil), rangeData...)
+	badData[0]++
+	if VerifyRangeProof(badData, proofSet, 10, 2, 5, root) {
+		t.Error("verified a proof with the wrong data")
+	}
+	if VerifyRangeProof(rangeData[1:], proofSet, 10, 2, 5, root) {
+		t.Error("verified a proof with a short segment in the middle of the tree")
+	}
+	if VerifyRangeProof(rangeData, proofSet[1:], 10, 2, 5, root) {
+		t.Error("verified a proof with a missing hash")
+	}
+	if VerifyRangeProof(rangeData, append(proofSet, Hash{}), 10, 2, 5, root) {
+		t.Error("verified a proof with an extra hash")
+	}
+}
+
+// TestMultiProof builds and verifies multi-proofs for random sets of indices.
+func TestMultiProof(t *testing.T) {
+	for _, size := range []int{1, SegmentSize*7 + 10, SegmentSize * 16, SegmentSize*37 + 5} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		numLeaves := CalculateLeaves(uint64(size))
+		for i := 0; i < 20; i++ {
+			indices := make([]uint64, fastrand.Intn(5)+1)
+			for j := range indices {
+				indices[j] = uint64(fastrand.Intn(int(numLeaves)))
+			}
+			segments, proofSet, err := BuildReaderMultiProof(bytes.NewReader(data), indices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted := sortedIndices(indices)
+			for j, index := range sorted {
+				base, _ := MerkleProof(data, index)
+				if !bytes.Equal(segments[j], base) {
+					t.Fatal("multi-proof returned the wrong segment for index", index)
+				}
+			}
+			if !VerifyMultiProof(segments, proofSet, numLeaves, indices, root) {
+				t.Fatalf("multi-proof for %v over %v leaves did not verify", indices, numLeaves)
+			}
+		}
+	}
+}
+
+// TestMultiProofSharedHashes checks that sibling hashes shared between
+// indices only appear once in a multi-proof.
+func TestMultiProofSharedHashes(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize * 16)
+	root := MerkleRoot(data)
+
+	// Indices 1 and 2 share the root of 8-15 and the root of 4-7, and each
+	// needs its own sibling leaf.
+	segments, proofSet, err := BuildReaderMultiProof(bytes.NewReader(data), []uint64{2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proofSet) != 4 {
+		t.Fatal("multi-proof has the wrong number of hashes:", len(proofSet))
+	}
+	if !VerifyMultiProof(segments, proofSet, 16, []uint64{1, 2}, root) {
+		t.Fatal("multi-proof did not verify")
+	}
+
+	// Try some bad proofs.
+	if VerifyMultiProof(segments, proofSet, 16, []uint64{1, 3}, root) {
+		t.Error("verified a multi-proof with the wrong indices")
+	}
+	if VerifyMultiProof(segments[:1], proofSet, 16, []uint64{1, 2}, root) {
+		t.Error("verified a multi-proof with a missing segment")
+	}
+	if VerifyMultiProof(segments, proofSet[1:], 16, []uint64{1, 2}, root) {
+		t.Error("verified a multi-proof with a missing hash")
+	}
+	if _, _, err := BuildReaderMultiProof(bytes.NewReader(data), []uint64{1, 16}); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+}
+
+// TestProofCoverage checks that ProofCoverage only accepts proof sets with
+// exactly the hashes needed for the claimed indices.
+func TestProofCoverage(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*37 + 5)
+	for i := 0; i < 20; i++ {
+		indices := make([]uint64, fastrand.Intn(5)+1)
+		for j := range indices {
+			indices[j] = uint64(fastrand.Intn(38))
+		}
+		_, proofSet, err := BuildReaderMultiProof(bytes.NewReader(data), indices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		covered, err := ProofCoverage(proofSet, 38, indices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sorted := sortedIndices(indices)
+		if len(covered) != len(sorted) {
+			t.Fatal("wrong coverage for", indices)
+		}
+		for j := range covered {
+			if covered[j] != sorted[j] {
+				t.Fatal("wrong coverage for", indices)
+			}
+		}
+	}
+
+	// A proof for fewer indices than claimed should be rejected.
+	_, proofSet, _ := BuildReaderMultiProof(bytes.NewReader(data), []uint64{3})
+	if _, err := ProofCoverage(proofSet, 38, []uint64{3, 20}); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := ProofCoverage(proofSet, 38, []uint64{3, 38}); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if _, err := ProofCoverage(proofSet, 38, nil); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+}
+
+// TestNormalizeIndices checks that indices are sorted, deduplicated, and
+// range-checked.
+func TestNormalizeIndices(t *testing.T) {
+	normalized, err := NormalizeIndices([]uint64{7, 2, 7, 0, 2, 9}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{0, 2, 7, 9}
+	if len(normalized) != len(expected) {
+		t.Fatal("wrong normalized indices:", normalized)
+	}
+	for i := range expected {
+		if normalized[i] != expected[i] {
+			t.Fatal("wrong normalized indices:", normalized)
+		}
+	}
+	if _, err := NormalizeIndices([]uint64{3, 10}, 10); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+	if normalized, err := NormalizeIndices(nil, 10); err != nil || len(normalized) != 0 {
+		t.Error("expected no indices and no error, got", normalized, err)
+	}
+}
+
+// TestChallengeIndices checks that challenge indices are distinct, in range,
+// and reproducible.
+func TestChallengeIndices(t *testing.T) {
+	seed := HashObject("block")
+	for _, numLeaves := range []uint64{1, 5, 64, 1 << 40} {
+		for _, count := range []int{0, 1, 3, 5, 10} {
+			indices := ChallengeIndices(seed, numLeaves, count)
+			expected := count
+			if uint64(expected) > numLeaves {
+				expected = int(numLeaves)
+			}
+			if len(indices) != expected {
+				t.Fatalf("expected %v indices, got %v", expected, len(indices))
+			}
+			seen := make(map[uint64]bool)
+			for _, index := range indices {
+				if index >= numLeaves || seen[index] {
+					t.Fatal("index out of range or duplicated:", index)
+				}
+				seen[index] = true
+			}
+			again := ChallengeIndices(seed, numLeaves, count)
+			for i := range indices {
+				if again[i] != indices[i] {
+					t.Fatal("challenge indices are not reproducible")
+				}
+			}
+		}
+	}
+
+	// The indices for a known seed should never change.
+	indices := ChallengeIndices(Hash{}, 1000, 3)
+	if len(indices) != 3 || indices[0] != 274 || indices[1] != 827 || indices[2] != 208 {
+		t.Fatal("challenge indices for the zero seed have changed:", indices)
+	}
+}
+
+// TestVerifyMultiProofAudit checks that an audit response fails if any one of
+// its segments is wrong.
+func TestVerifyMultiProofAudit(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*40 + 7)
+	root := MerkleRoot(data)
+	indices := ChallengeIndices(HashObject("seed"), 41, 6)
+	segments, proofSet, err := BuildReaderMultiProof(bytes.NewReader(data), indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyMultiProof(segments, proofSet, 41, indices, root) {
+		t.Fatal("audit response did not verify")
+	}
+	for i := range segments {
+		segments[i][0]++
+		if VerifyMultiProof(segments, proofSet, 41, indices, root) {
+			t.Error("audit response verified with a corrupt segment", i)
+		}
+		segments[i][0]--
+	}
+}
+
+// tailTestRoots returns the roots of the subtrees of 'height' that make up
+// 'data', as they would be pushed to a CachedMerkleTree.
+func tailTestRoots(data []byte, height uint64) []Hash {
+	var roots []Hash
+	for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+		roots = append(roots, MerkleRoot(buf.Next(SegmentSize<<height)))
+	}
+	return roots
+}
+
+// offsetReaderAt is an io.ReaderAt that fails any read before 'min'.
+type offsetReaderAt struct {
+	r   io.ReaderAt
+	min int64
+}
+
+func (or offsetReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < or.min {
+		return 0, errors.New("read before the tail")
+	}
+	return or.r.ReadAt(p, off)
+}
+
+// TestBuildTailProof checks that tail proofs match BuildReaderProof for trees
+// of several sizes, and that the data covered by cached subtrees is not read.
+func TestBuildTailProof(t *testing.T) {
+	for _, size := range []int{1, SegmentSize, SegmentSize*3 + 1, SegmentSize * 8, SegmentSize*13 + 40} {
+		data := fastrand.Bytes(size)
+		numLeaves := CalculateLeaves(uint64(size))
+		root := MerkleRoot(data)
+		for height := uint64(0); height < 4; height++ {
+			roots := tailTestRoots(data, height)
+			for lastN := uint64(1); lastN <= numLeaves; lastN++ {
+				min := int64((numLeaves-lastN)>>height<<height) * SegmentSize
+				proofs, err := BuildTailProof(offsetReaderAt{bytes.NewReader(data), min}, int64(size), lastN, roots, height)
+				if err != nil {
+					t.Fatal(err)
+				} else if uint64(len(proofs)) != lastN {
+					t.Fatal("wrong number of proofs:", len(proofs))
+				}
+				for _, sp := range proofs {
+					base, hashSet, err := BuildReaderProof(bytes.NewReader(data), sp.Index)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if sp.Root != root || sp.NumLeaves != numLeaves || !bytes.Equal(sp.Base, base) || len(sp.HashSet) != len(hashSet) {
+						t.Fatalf("tail proof for index %v of %v bytes does not match BuildReaderProof", sp.Index, size)
+					}
+					for i := range hashSet {
+						if sp.HashSet[i] != hashSet[i] {
+							t.Fatalf("tail proof for index %v of %v bytes does not match BuildReaderProof", sp.Index, size)
+						}
+					}
+					if !VerifySegment(sp.Base, sp.HashSet, sp.NumLeaves, sp.Index, root) {
+						t.Fatalf("tail proof for index %v of %v bytes did not verify", sp.Index, size)
+					}
+				}
+			}
+			if _, err := BuildTailProof(bytes.NewReader(data), int64(size), numLeaves+1, roots, height); err != ErrInvalidRange {
+				t.Error("expected ErrInvalidRange, got", err)
+			}
+		}
+
+		// Without cached roots, only a tail that starts at the first segment
+		// can be proven.
+		if _, err := BuildTailProof(bytes.NewReader(data), int64(size), numLeaves, nil, 0); err != nil {
+			t.Error(err)
+		}
+		if numLeaves > 1 {
+			if _, err := BuildTailProof(bytes.NewReader(data), int64(size), 1, nil, 0); err != ErrInvalidRange {
+				t.Error("expected ErrInvalidRange for missing subtree roots, got", err)
+			}
+		}
+	}
+	if _, err := BuildTailProof(bytes.NewReader(nil), 0, 1, nil, 0); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange for empty data, got", err)
+	}
+
+	// Data larger than a single buffered read.
+	data := fastrand.Bytes(bufferedReadSize*2 + SegmentSize*5 + 3)
+	numLeaves := CalculateLeaves(uint64(len(data)))
+	roots := tailTestRoots(data, 4)
+	proofs, err := BuildTailProof(bytes.NewReader(data), int64(len(data)), 100, roots, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sp := range proofs {
+		if !VerifySegmentSegSize(sp.Base, sp.HashSet, numLeaves, sp.Index, MerkleRoot(data), SegmentSize) {
+			t.Fatal("tail proof did not verify for index", sp.Index)
+		}
+	}
+	if _, err := BuildTailProof(bytes.NewReader(data[:len(data)-1]), int64(len(data)), 1, roots, 4); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF for short data, got", err)
+	}
+}
+
+// TestBlockProof builds and verifies a block proof for every block of several
+// trees, and checks that ranges that are not blocks are rejected.
+func TestBlockProof(t *testing.T) {
+	for _, size := range []int{SegmentSize, SegmentSize*7 + 3, SegmentSize * 8, SegmentSize*13 + 40} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		numLeaves := CalculateLeaves(uint64(size))
+		numBlocks := 0
+		for start := uint64(0); start < numLeaves; start++ {
+			for end := start + 1; end <= numLeaves; end++ {
+				blockRoot, blockProof, err := BuildBlockProof(bytes.NewReader(data), int64(size), start, end)
+				if _, ok := blockHeight(numLeaves, start, end); !ok {
+					if err != ErrInvalidRange {
+						t.Fatalf("expected ErrInvalidRange for [%v, %v) of %v leaves, got %v", start, end, numLeaves, err)
+					}
+					continue
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				numBlocks++
+				blockEnd := end * SegmentSize
+				if blockEnd > uint64(size) {
+					blockEnd = uint64(size)
+				}
+				if blockRoot != MerkleRoot(data[start*SegmentSize:blockEnd]) {
+					t.Fatalf("wrong block root for [%v, %v) of %v leaves", start, end, numLeaves)
+				}
+				if !VerifyBlockProof(blockRoot, blockProof, numLeaves, start, end, root) {
+					t.Fatalf("block proof for [%v, %v) of %v leaves did not verify", start, end, numLeaves)
+				}
+				blockRoot[0]++
+				if VerifyBlockProof(blockRoot, blockProof, numLeaves, start, end, root) {
+					t.Fatalf("corrupt block root for [%v, %v) of %v leaves verified", start, end, numLeaves)
+				}
+			}
+		}
+		if numBlocks < int(numLeaves) {
+			t.Fatal("too few blocks were tested:", numBlocks)
+		}
+	}
+}
+
+// TestAdjacentProof checks that adjacent proofs verify for every pair of
+// segments, and are no larger than a proof of either segment alone plus one
+// hash.
+func TestAdjacentProof(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*11 + 20)
+	root := MerkleRoot(data)
+	for index := uint64(0); index < 11; index++ {
+		segA, segB, proof, err := BuildAdjacentProof(bytes.NewReader(data), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyAdjacentProof(segA, segB, proof, 12, index, root) {
+			t.Fatal("adjacent proof did not verify for index", index)
+		}
+		if VerifyAdjacentProof(segB, segA, proof, 12, index, root) {
+			t.Fatal("adjacent proof verified with the segments swapped for index", index)
+		}
+		if len(proof) > ProofSize(12, index)+1 {
+			t.Fatalf("adjacent proof for index %v has %v hashes", index, len(proof))
+		}
+	}
+	if _, _, _, err := BuildAdjacentProof(bytes.NewReader(data), 11); err != ErrInvalidRange {
+		t.Error("expected ErrInvalidRange, got", err)
+	}
+}
@@ -0,0 +1,85 @@
+package crypto
+
+// merklereader.go contains a reader that verifies each segment of a download
+// against a Merkle root before passing it on, so that corruption is detected
+// as soon as the corrupt segment arrives.
+
+import (
+	"io"
+)
+
+// A ProofSource supplies the storage proof for each segment read by a
+// verified reader.
+type ProofSource interface {
+	// Proof returns the hash set proving the segment at 'index'.
+	Proof(index uint64) ([]Hash, error)
+}
+
+// verifiedReader is the io.Reader returned by NewVerifiedReader.
+type verifiedReader struct {
+	src       io.Reader
+	root      Hash
+	numLeaves uint64
+	proofs    ProofSource
+
+	index   uint64
+	segment [SegmentSize]byte
+	pending []byte
+	err     error
+}
+
+// NewVerifiedReader returns a reader that reads the data of a tree with
+// 'numLeaves' leaves and the Merkle root 'root' from 'src'. Each segment is
+// verified against the proof supplied by 'proofs' before any of its bytes are
+// returned. The first segment that fails to verify causes Read to return an
+// error, as does data that ends early or continues past the final leaf.
+func NewVerifiedReader(src io.Reader, root Hash, numLeaves uint64, proofs ProofSource) io.Reader {
+	return &verifiedReader{
+		src:       src,
+		root:      root,
+		numLeaves: numLeaves,
+		proofs:    proofs,
+	}
+}
+
+// Read implements io.Reader.
+func (vr *verifiedReader) Read(p []byte) (int, error) {
+	for len(vr.pending) == 0 {
+		if vr.err != nil {
+			return 0, vr.err
+		}
+		vr.err = vr.nextSegment()
+	}
+	n := copy(p, vr.pending)
+	vr.pending = vr.pending[n:]
+	return n, nil
+}
+
+// nextSegment reads and verifies the next segment, storing it in vr.pending.
+func (vr *verifiedReader) nextSegment() error {
+	n, err := io.ReadFull(vr.src, vr.segment[:])
+	if err == io.EOF {
+		if vr.index != vr.numLeaves {
+			return io.ErrUnexpectedEOF
+		}
+		return io.EOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if vr.index >= vr.numLeaves {
+		return ErrIndexOutOfRange
+	} else if n < SegmentSize && vr.index != vr.numLeaves-1 {
+		return io.ErrUnexpectedEOF
+	}
+
+	hashSet, err := vr.proofs.Proof(vr.index)
+	if err != nil {
+		return err
+	}
+	if err := VerifySegmentErr(vr.segment[:n], hashSet, vr.numLeaves, vr.index, vr.root); err != nil {
+		return err
+	}
+	vr.pending = vr.segment[:n]
+	vr.index++
+	return nil
+}
@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// sliceProofSource is a ProofSource that builds proofs from a byte slice.
+type sliceProofSource []byte
+
+// Proof implements ProofSource.
+func (sps sliceProofSource) Proof(index uint64) ([]Hash, error) {
+	_, hashSet := MerkleProof(sps, index)
+	return hashSet, nil
+}
+
+// TestVerifiedReader checks that a verified reader returns correct data and
+// stops at the first corrupt segment.
+func TestVerifiedReader(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*9 + 13)
+	root := MerkleRoot(data)
+	vr := NewVerifiedReader(bytes.NewReader(data), root, 10, sliceProofSource(data))
+	read, err := ioutil.ReadAll(vr)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(read, data) {
+		t.Fatal("verified reader returned the wrong data")
+	}
+
+	// Corrupt a segment in the middle of the data.
+	bad := append([]byte(nil), data...)
+	bad[5*SegmentSize+3]++
+	vr = NewVerifiedReader(bytes.NewReader(bad), root, 10, sliceProofSource(data))
+	read, err = ioutil.ReadAll(vr)
+	if err != ErrRootMismatch {
+		t.Fatal("expected ErrRootMismatch, got", err)
+	} else if !bytes.Equal(read, data[:5*SegmentSize]) {
+		t.Fatal("verified reader did not stop at the corrupt segment")
+	}
+
+	// Truncated and extended data should be rejected.
+	vr = NewVerifiedReader(bytes.NewReader(data[:SegmentSize*9]), root, 10, sliceProofSource(data))
+	if _, err := ioutil.ReadAll(vr); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+	vr = NewVerifiedReader(bytes.NewReader(append(data, 0)), root, 10, sliceProofSource(data))
+	if _, err := ioutil.ReadAll(vr); err == nil {
+		t.Error("expected an error for data past the final leaf")
+	}
+}
@@ -0,0 +1,76 @@
+package crypto
+
+// merklesector.go contains a helper for computing the Merkle roots of a
+// stream of fixed-size sectors without allocating for each sector.
+
+import (
+	"errors"
+	"io"
+)
+
+// A SectorRooter computes the Merkle roots of sectors of a fixed size,
+// reusing its segment buffer and subtree stack between sectors. It is not
+// safe for concurrent use.
+type SectorRooter struct {
+	sectorSize int
+	segment    [SegmentSize]byte
+	stack      leafStack
+}
+
+// NewSectorRooter returns a SectorRooter for sectors of 'sectorSize' bytes.
+// The size must be positive.
+func NewSectorRooter(sectorSize int) *SectorRooter {
+	if sectorSize <= 0 {
+		panic("sectorSize must be positive")
+	}
+	return &SectorRooter{
+		sectorSize: sectorSize,
+	}
+}
+
+// RootOf reads exactly one sector from 'r' and returns its Merkle root. No
+// more than a sector is read, so successive calls can consume a stream of
+// back-to-back sectors. If 'r' ends partway through the sector,
+// io.ErrUnexpectedEOF is returned; if it ends before the sector, io.EOF is
+// returned.
+func (sr *SectorRooter) RootOf(r io.Reader) (Hash, error) {
+	sr.stack.reset()
+	for remaining := sr.sectorSize; remaining > 0; {
+		segment := sr.segment[:]
+		if remaining < SegmentSize {
+			segment = segment[:remaining]
+		}
+		if _, err := io.ReadFull(r, segment); err == io.EOF && remaining < sr.sectorSize {
+			return Hash{}, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return Hash{}, err
+		}
+		remaining -= len(segment)
+		sr.stack.push(leafSum(segment))
+	}
+	return sr.stack.root(), nil
+}
+
+// SectorRoots splits the data in 'r' into sectors of 'sectorSize' bytes and
+// returns the Merkle root of each, in order. The final sector may be shorter
+// than 'sectorSize', and is rooted as ReaderMerkleRoot would root it. Empty
+// data has no sectors.
+func SectorRoots(r io.Reader, sectorSize int) ([]Hash, error) {
+	if sectorSize <= 0 {
+		return nil, errors.New("sector size must be positive")
+	}
+	var roots []Hash
+	buf := make([]byte, sectorSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return roots, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		roots = append(roots, MerkleRoot(buf[:n]))
+		if n < sectorSize {
+			return roots, nil
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestSectorRooter checks that a SectorRooter computes the root of each sector
+// in a stream.
+func TestSectorRooter(t *testing.T) {
+	for _, sectorSize := range []int{1, SegmentSize, SegmentSize*16 + 5} {
+		data := fastrand.Bytes(sectorSize * 5)
+		sr := NewSectorRooter(sectorSize)
+		r := bytes.NewReader(data)
+		for i := 0; i < 5; i++ {
+			root, err := sr.RootOf(r)
+			if err != nil {
+				t.Fatal(err)
+			} else if root != MerkleRoot(data[i*sectorSize:(i+1)*sectorSize]) {
+				t.Fatalf("wrong root for sector %v of size %v", i, sectorSize)
+			}
+		}
+		if _, err := sr.RootOf(r); err != io.EOF {
+			t.Fatal("expected io.EOF at the end of the stream, got", err)
+		}
+	}
+
+	// A partial sector should be reported.
+	sr := NewSectorRooter(SegmentSize * 4)
+	if _, err := sr.RootOf(bytes.NewReader(make([]byte, SegmentSize*3))); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+}
+
+// TestSectorRoots checks that SectorRoots roots each sector, including a short
+// final sector, as ReaderMerkleRoot does.
+func TestSectorRoots(t *testing.T) {
+	const sectorSize = SegmentSize*4 + 10
+	for _, size := range []int{0, 1, sectorSize, sectorSize*3 + 70} {
+		data := fastrand.Bytes(size)
+		roots, err := SectorRoots(bytes.NewReader(data), sectorSize)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(roots) != (size+sectorSize-1)/sectorSize {
+			t.Fatalf("wrong number of roots for %v bytes: %v", size, len(roots))
+		}
+		for i, root := range roots {
+			end := (i + 1) * sectorSize
+			if end > size {
+				end = size
+			}
+			exp, _ := ReaderMerkleRoot(bytes.NewReader(data[i*sectorSize : end]))
+			if root != exp {
+				t.Fatalf("wrong root for sector %v of %v bytes", i, size)
+			}
+		}
+	}
+	if _, err := SectorRoots(bytes.NewReader(nil), 0); err == nil {
+		t.Error("expected an error for a sector size of 0")
+	}
+}
@@ -0,0 +1,153 @@
+package crypto
+
+// merklesparse.go contains a sparse Merkle tree, which commits to a value for
+// every index in a space of 1<<height indices. Almost all of the indices are
+// expected to be empty, so only the nodes above non-empty leaves are stored;
+// the root of every empty subtree is known in advance.
+
+import (
+	"errors"
+)
+
+var (
+	// ErrLeafNotEmpty is returned when proving that a leaf of a SparseTree is
+	// empty when it holds a value.
+	ErrLeafNotEmpty = errors.New("sparse tree leaf is not empty")
+)
+
+// A SparseTree is a Merkle tree over a fixed space of 1<<height leaves, each of
+// which holds a Hash. A leaf holding the zero Hash is empty. Each leaf is
+// hashed as a leaf with its value as the data, and nodes are hashed as in
+// MerkleTree.
+type SparseTree struct {
+	height uint64
+
+	// nodes holds the root of every non-empty subtree. emptyRoots[h] is the
+	// root of an empty subtree of height h.
+	nodes      map[sparseNode]Hash
+	emptyRoots []Hash
+}
+
+// sparseNode identifies the subtree of 'height' covering the leaves starting
+// at index<<height.
+type sparseNode struct {
+	height uint64
+	index  uint64
+}
+
+// sparseEmptyRoots returns the roots of empty subtrees of height 0 through
+// 'height'.
+func sparseEmptyRoots(height uint64) []Hash {
+	emptyRoots := make([]Hash, height+1)
+	emptyRoots[0] = leafSum(make([]byte, HashSize))
+	for h := uint64(1); h <= height; h++ {
+		emptyRoots[h] = nodeSum(emptyRoots[h-1], emptyRoots[h-1])
+	}
+	return emptyRoots
+}
+
+// NewSparseTree returns an empty SparseTree with 1<<height leaves. The height
+// may be at most 64.
+func NewSparseTree(height uint64) *SparseTree {
+	if height > 64 {
+		panic("sparse tree height may be at most 64")
+	}
+	return &SparseTree{
+		height:     height,
+		nodes:      make(map[sparseNode]Hash),
+		emptyRoots: sparseEmptyRoots(height),
+	}
+}
+
+// checkIndex panics if 'index' is not a leaf of the tree.
+func (st *SparseTree) checkIndex(index uint64) {
+	if st.height < 64 && index >= 1<<st.height {
+		panic(ErrIndexOutOfRange)
+	}
+}
+
+// node returns the root of the subtree identified by 'n'.
+func (st *SparseTree) node(n sparseNode) Hash {
+	if h, ok := st.nodes[n]; ok {
+		return h
+	}
+	return st.emptyRoots[n.height]
+}
+
+// Set stores 'value' at leaf 'index', and updates each node above it. Setting
+// a leaf to the zero Hash empties it.
+func (st *SparseTree) Set(index uint64, value Hash) {
+	st.checkIndex(index)
+	sum := leafSum(value[:])
+	for h := uint64(0); ; h++ {
+		// Only non-empty subtrees are stored.
+		n := sparseNode{height: h, index: index}
+		if sum == st.emptyRoots[h] {
+			delete(st.nodes, n)
+		} else {
+			st.nodes[n] = sum
+		}
+		if h == st.height {
+			return
+		}
+		sibling := st.node(sparseNode{height: h, index: index ^ 1})
+		if index&1 == 0 {
+			sum = nodeSum(sum, sibling)
+		} else {
+			sum = nodeSum(sibling, sum)
+		}
+		index >>= 1
+	}
+}
+
+// Root returns the Merkle root of the tree.
+func (st *SparseTree) Root() Hash {
+	return st.node(sparseNode{height: st.height})
+}
+
+// Prove returns a proof of the value at leaf 'index', which is the sibling of
+// each node on the path from the leaf to the root, from the bottom of the tree
+// to the top. It proves the value whether or not the leaf is empty, so it
+// also serves as a proof that an empty leaf is empty. See VerifySparseProof.
+func (st *SparseTree) Prove(index uint64) []Hash {
+	st.checkIndex(index)
+	proof := make([]Hash, st.height)
+	for h := range proof {
+		proof[h] = st.node(sparseNode{height: uint64(h), index: (index >> uint64(h)) ^ 1})
+	}
+	return proof
+}
+
+// ProveAbsence returns a proof that leaf 'index' is empty. It is the same as
+// Prove, but returns ErrLeafNotEmpty if the leaf holds a value. See
+// VerifyAbsence.
+func (st *SparseTree) ProveAbsence(index uint64) ([]Hash, error) {
+	st.checkIndex(index)
+	if _, ok := st.nodes[sparseNode{height: 0, index: index}]; ok {
+		return nil, ErrLeafNotEmpty
+	}
+	return st.Prove(index), nil
+}
+
+// VerifySparseProof verifies that leaf 'index' of a SparseTree of 'height'
+// with Merkle root 'root' holds 'value', given a proof built by Prove.
+func VerifySparseProof(index uint64, value Hash, proof []Hash, root Hash, height uint64) bool {
+	if height > 64 || uint64(len(proof)) != height || (height < 64 && index >= 1<<height) {
+		return false
+	}
+	sum := leafSum(value[:])
+	for h, sibling := range proof {
+		if (index>>uint64(h))&1 == 0 {
+			sum = nodeSum(sum, sibling)
+		} else {
+			sum = nodeSum(sibling, sum)
+		}
+	}
+	return rootsEqual(sum, root)
+}
+
+// VerifyAbsence verifies that leaf 'index' of a SparseTree of 'height' with
+// Merkle root 'root' is empty, given a proof built by ProveAbsence.
+func VerifyAbsence(index uint64, proof []Hash, root Hash, height uint64) bool {
+	return VerifySparseProof(index, Hash{}, proof, root, height)
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestSparseTree checks that a SparseTree matches a MerkleTree holding the
+// same leaves, and that its proofs verify.
+func TestSparseTree(t *testing.T) {
+	const height = 4
+	st := NewSparseTree(height)
+	values := make([]Hash, 1<<height)
+	for _, index := range []uint64{0, 5, 6, 15} {
+		fastrand.Read(values[index][:])
+		st.Set(index, values[index])
+	}
+	tree := NewTree()
+	for _, v := range values {
+		tree.Push(v[:])
+	}
+	if st.Root() != tree.Root() {
+		t.Fatal("sparse tree does not match the equivalent full tree")
+	}
+	for index, v := range values {
+		proof := st.Prove(uint64(index))
+		if !VerifySparseProof(uint64(index), v, proof, st.Root(), height) {
+			t.Fatal("proof did not verify for index", index)
+		}
+		if VerifySparseProof(uint64(index), HashBytes(v[:]), proof, st.Root(), height) {
+			t.Fatal("proof verified with the wrong value for index", index)
+		}
+	}
+
+	// Emptying every leaf should produce the root of an empty tree, and no
+	// nodes should be left behind.
+	for index := range values {
+		st.Set(uint64(index), Hash{})
+	}
+	if st.Root() != NewSparseTree(height).Root() || len(st.nodes) != 0 {
+		t.Fatal("emptied tree does not match an empty tree")
+	}
+}
+
+// TestSparseTreeLarge checks that a tree over a 64-bit index space can be used
+// cheaply.
+func TestSparseTreeLarge(t *testing.T) {
+	st := NewSparseTree(64)
+	empty := st.Root()
+	var value Hash
+	fastrand.Read(value[:])
+	index := fastrand.Uint64n(1 << 63)
+	st.Set(index, value)
+	if st.Root() == empty {
+		t.Fatal("root did not change")
+	} else if len(st.nodes) != 65 {
+		t.Fatal("wrong number of stored nodes:", len(st.nodes))
+	}
+	if !VerifySparseProof(index, value, st.Prove(index), st.Root(), 64) {
+		t.Fatal("proof did not verify")
+	}
+	if !VerifySparseProof(index+1, Hash{}, st.Prove(index+1), st.Root(), 64) {
+		t.Fatal("proof of an empty leaf did not verify")
+	}
+}
+
+// TestSparseTreeAbsence checks that only empty leaves can be proven absent.
+func TestSparseTreeAbsence(t *testing.T) {
+	const height = 10
+	st := NewSparseTree(height)
+	var value Hash
+	fastrand.Read(value[:])
+	st.Set(300, value)
+
+	if _, err := st.ProveAbsence(300); err != ErrLeafNotEmpty {
+		t.Fatal("expected ErrLeafNotEmpty, got", err)
+	}
+	proof, err := st.ProveAbsence(301)
+	if err != nil {
+		t.Fatal(err)
+	} else if !VerifyAbsence(301, proof, st.Root(), height) {
+		t.Fatal("absence proof did not verify")
+	}
+	if VerifyAbsence(300, st.Prove(300), st.Root(), height) {
+		t.Fatal("absence verified for a non-empty leaf")
+	}
+	if VerifyAbsence(301, proof, st.Root(), height+1) || VerifyAbsence(302, proof, st.Root(), height) {
+		t.Fatal("absence proof verified with the wrong height or index")
+	}
+
+	// Once the leaf is set, the old absence proof no longer verifies.
+	st.Set(301, value)
+	if VerifyAbsence(301, proof, st.Root(), height) {
+		t.Fatal("stale absence proof verified")
+	}
+}
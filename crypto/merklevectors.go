@@ -0,0 +1,123 @@
+package crypto
+
+// merklevectors.go contains known-good Merkle roots and proofs, which pin the
+// hashing behavior of the package and allow other implementations to check
+// that they are compatible.
+//
+// The roots do not depend on the byte order of the platform. Leaves are hashed
+// as raw bytes, and nodes as the concatenation of their children's hashes; no
+// leaf count or index is ever hashed. Where integers are encoded alongside
+// roots, as in MarshalState, MarshalProofFull, and ChallengeIndices, they are
+// always little-endian.
+
+import (
+	"encoding/hex"
+)
+
+// A MerkleVector is a known-good Merkle root and storage proof for a piece of
+// data. Base and HashSet are the proof for the segment at Index.
+type MerkleVector struct {
+	Data    []byte
+	Index   uint64
+	Root    Hash
+	Base    []byte
+	HashSet []Hash
+}
+
+// merkleVectors holds the expected outputs for each vector. The data of each
+// vector is generated by vectorData.
+var merkleVectors = []struct {
+	size    int
+	index   uint64
+	root    string
+	hashSet []string
+}{
+	{1, 0, "9ee6dfb61a2fb903df487c401663825643bb825d41695e63df8af6162ab145a6", nil},
+	{64, 0, "5450d0d0dc7eb22a12f09617236354bde65426d37c7221ea1dad7ff37b58ab26", nil},
+	{65, 1, "063c0a6b0a9c8bef29e71bad71c765c52b3c072ad39fc90237c636fd3206a355", []string{
+		"5450d0d0dc7eb22a12f09617236354bde65426d37c7221ea1dad7ff37b58ab26",
+	}},
+	{128, 1, "4c4eb6762fac662b259e12798162aa15d88bf32b897a2ec195f902b2a58491ec", []string{
+		"5450d0d0dc7eb22a12f09617236354bde65426d37c7221ea1dad7ff37b58ab26",
+	}},
+	{200, 2, "429a6180cb60ea259ece7eb0851ee659ddf2a3464dae98a3784b988f4cb3c0a2", []string{
+		"b6dac03a1fa850623d40fd67641286e3da205c1acf3056ab1b510ccb939f2bcd",
+		"4c4eb6762fac662b259e12798162aa15d88bf32b897a2ec195f902b2a58491ec",
+	}},
+	{320, 3, "85111625ad25f07886128e3f9fac970eb8fc38c04fe40aa22abcaf6fcc842e32", []string{
+		"827635716684d2b086b0ae88ce463df1f6fc19ea8863aed9ce206d791ec19cf9",
+		"4c4eb6762fac662b259e12798162aa15d88bf32b897a2ec195f902b2a58491ec",
+		"b554dfbf444c25a5bf9ede45da1a95a4345abe22ef5e90620ffbb28b243dc038",
+	}},
+	{448, 5, "f10f6029affa45e47f443d9941a168ce37e51c394d883507e47c1b73a189fb8f", []string{
+		"b554dfbf444c25a5bf9ede45da1a95a4345abe22ef5e90620ffbb28b243dc038",
+		"cd6ba806798204d9757a1eed7dd7d7a864c84f855e475de71bf5c8e6a72ee34c",
+		"b790279b2a780f839ef2d6abe11306c11693d29e33b52a1a3afcf71fca48fb1b",
+	}},
+	{451, 7, "9d327e7591babdbc32d495feac821efa1632ba1d78e12cf09458c7b9d1fe48c4", []string{
+		"cd6ba806798204d9757a1eed7dd7d7a864c84f855e475de71bf5c8e6a72ee34c",
+		"5c90d2beadd4a0f0573627db0febd163270286fd72ca7f8be03277778894bf04",
+		"b790279b2a780f839ef2d6abe11306c11693d29e33b52a1a3afcf71fca48fb1b",
+	}},
+}
+
+// vectorData returns the data of a test vector of 'size' bytes. Byte i is
+// i%251, so that no two segments of a vector are the same.
+func vectorData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// mustDecodeHash decodes a hex-encoded hash, panicking if it is malformed.
+func mustDecodeHash(s string) (h Hash) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != HashSize {
+		panic("malformed hash in test vector: " + s)
+	}
+	copy(h[:], b)
+	return h
+}
+
+// TestVectors returns a set of known-good Merkle roots and proofs. The vectors
+// cover trees with a single leaf, full and partial final leaves, and trees
+// whose leaf count is not a power of two.
+func TestVectors() []MerkleVector {
+	vectors := make([]MerkleVector, len(merkleVectors))
+	for i, v := range merkleVectors {
+		data := vectorData(v.size)
+		start, end := LeafRange(v.index)
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		vectors[i] = MerkleVector{
+			Data:  data,
+			Index: v.index,
+			Root:  mustDecodeHash(v.root),
+			Base:  data[start:end],
+		}
+		for _, h := range v.hashSet {
+			vectors[i].HashSet = append(vectors[i].HashSet, mustDecodeHash(h))
+		}
+	}
+	return vectors
+}
+
+// A RootTester reports a failed root check. testing.TB implements it; the
+// testing package itself is not imported, so that importing this package does
+// not register the test flags.
+type RootTester interface {
+	Fatalf(format string, args ...interface{})
+}
+
+// AssertRootStable fails 't' if the Merkle root of 'data' is not 'expected'.
+// Downstream code can use it to pin roots recorded by an earlier version of
+// this package, guarding against changes to the hashing that would break
+// consensus.
+func AssertRootStable(t RootTester, data []byte, expected Hash) {
+	if root := MerkleRoot(data); root != expected {
+		t.Fatalf("Merkle root of %v bytes has changed: expected %v, got %v", len(data), expected, root)
+	}
+}
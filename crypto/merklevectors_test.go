@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestMerkleVectors checks that the package produces the roots and proofs in
+// TestVectors.
+func TestMerkleVectors(t *testing.T) {
+	for _, v := range TestVectors() {
+		if MerkleRoot(v.Data) != v.Root {
+			t.Errorf("wrong root for %v bytes", len(v.Data))
+		}
+		base, hashSet, err := BuildReaderProof(bytes.NewReader(v.Data), v.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(base, v.Base) {
+			t.Errorf("wrong base for index %v of %v bytes", v.Index, len(v.Data))
+		}
+		if len(hashSet) != len(v.HashSet) {
+			t.Errorf("wrong proof length for index %v of %v bytes", v.Index, len(v.Data))
+			continue
+		}
+		for i := range hashSet {
+			if hashSet[i] != v.HashSet[i] {
+				t.Errorf("wrong proof hash %v for index %v of %v bytes", i, v.Index, len(v.Data))
+			}
+		}
+		if !VerifySegment(v.Base, v.HashSet, CalculateLeaves(uint64(len(v.Data))), v.Index, v.Root) {
+			t.Errorf("vector for index %v of %v bytes did not verify", v.Index, len(v.Data))
+		}
+	}
+}
+
+// TestByteOrder checks that the integers encoded alongside roots and proofs
+// are little-endian regardless of the platform.
+func TestByteOrder(t *testing.T) {
+	le := []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+	b := MarshalProofFull(nil, nil, 0x0102030405060708, 0x0102030405060708)
+	if !bytes.Equal(b[2:10], le) || !bytes.Equal(b[10:18], le) {
+		t.Fatal("MarshalProofFull did not encode integers as little-endian:", b[2:18])
+	}
+
+	tree := NewTree()
+	for i := 0; i < 0x0102; i++ {
+		tree.Push([]byte{byte(i)})
+	}
+	state, err := tree.MarshalState()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(state[:8], []byte{0x02, 0x01, 0, 0, 0, 0, 0, 0}) {
+		t.Fatal("MarshalState did not encode the leaf count as little-endian:", state[:8])
+	}
+
+	// The vectors pin the roots themselves; a root that depended on the
+	// platform's byte order would fail them on one platform or the other.
+	for _, v := range TestVectors() {
+		if MerkleRoot(v.Data) != v.Root {
+			t.Fatalf("wrong root for %v bytes", len(v.Data))
+		}
+	}
+}
+
+// fatalRecorder is a RootTester that records whether Fatalf was called.
+type fatalRecorder struct {
+	failed bool
+}
+
+func (fr *fatalRecorder) Fatalf(format string, args ...interface{}) { fr.failed = true }
+
+// TestAssertRootStable checks that AssertRootStable accepts the vectors and
+// fails on a changed root.
+func TestAssertRootStable(t *testing.T) {
+	for _, v := range TestVectors() {
+		AssertRootStable(t, v.Data, v.Root)
+	}
+	var fr fatalRecorder
+	AssertRootStable(&fr, []byte{1}, Hash{})
+	if !fr.failed {
+		t.Error("AssertRootStable did not fail for the wrong root")
+	}
+}
@@ -0,0 +1,353 @@
+package crypto
+
+// merkleverifier.go contains functions for verifying storage proofs. The
+// ProofVerifier checks a proof one hash at a time, and the remaining functions
+// build on it to verify proofs read from streams, proofs in batches, and
+// proofs that span two levels of trees.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// VerifyScratchSize is the minimum size of the scratch buffer passed to
+	// VerifySegmentBuf. It holds a node prefix and two child hashes, or a leaf
+	// prefix and a full segment.
+	VerifyScratchSize = 1 + 2*HashSize
+)
+
+var (
+	// errProofOutOfOrder is returned when proof hashes are written to a
+	// ProofVerifier before the segment.
+	errProofOutOfOrder = errors.New("segment must be written before proof hashes")
+)
+
+// A SegmentProof bundles a storage proof with the parameters needed to verify
+// it, for use with VerifyBatch.
+type SegmentProof struct {
+	Base      []byte
+	HashSet   []Hash
+	NumLeaves uint64
+	Index     uint64
+	Root      Hash
+}
+
+// FileContractLike is implemented by types that hold the Merkle root and size
+// of a file, such as wrappers around file contracts. types.FileContract cannot
+// implement it directly, because its FileSize field would clash with the
+// method.
+type FileContractLike interface {
+	MerkleRoot() Hash
+	FileSize() uint64
+}
+
+// A ProofVerifier verifies a storage proof incrementally, allowing the proof
+// hashes to be supplied as they arrive instead of all at once. The segment must
+// be written first, followed by each hash of the proof in order.
+type ProofVerifier struct {
+	index uint64
+	root  Hash
+
+	// hasher is used in place of blake2b if it is not nil.
+	hasher hash.Hash
+
+	// The shape of the proof, as returned by proofShape.
+	height    uint64
+	right     bool
+	numHashes int
+
+	sum            Hash
+	hashesWritten  int
+	segmentWritten bool
+	err            error
+}
+
+// NewProofVerifier returns a ProofVerifier for the segment at 'index' of a
+// tree with 'numLeaves' leaves and the Merkle root 'root'.
+func NewProofVerifier(numLeaves, index uint64, root Hash) *ProofVerifier {
+	pv := &ProofVerifier{
+		index: index,
+		root:  root,
+	}
+	if index >= numLeaves {
+		pv.err = ErrIndexOutOfRange
+		return pv
+	}
+	var left int
+	pv.height, pv.right, left = proofShape(numLeaves, index)
+	pv.numHashes = int(pv.height) + left
+	if pv.right {
+		pv.numHashes++
+	}
+	return pv
+}
+
+// WriteSegment supplies the segment being proven.
+func (pv *ProofVerifier) WriteSegment(segment []byte) error {
+	if pv.err != nil {
+		return pv.err
+	} else if pv.segmentWritten {
+		return errors.New("segment has already been written")
+	}
+	pv.sum = leafSumWith(pv.hasher, segment)
+	pv.segmentWritten = true
+	return nil
+}
+
+// WriteProofHash supplies the next hash of the proof.
+func (pv *ProofVerifier) WriteProofHash(h Hash) error {
+	if pv.err != nil {
+		return pv.err
+	} else if !pv.segmentWritten {
+		return errProofOutOfOrder
+	} else if pv.hashesWritten == pv.numHashes {
+		pv.err = ErrProofWrongLength
+		return pv.err
+	}
+
+	// The first 'height' hashes are siblings within the perfect subtree
+	// containing the segment, and the bits of the index give their sides.
+	// They are followed by the root of everything to the right of that
+	// subtree, if anything is there, and then each subtree to the left.
+	i := uint64(pv.hashesWritten)
+	if i < pv.height && (pv.index>>i)&1 == 0 {
+		pv.sum = nodeSumWith(pv.hasher, pv.sum, h)
+	} else if i < pv.height {
+		pv.sum = nodeSumWith(pv.hasher, h, pv.sum)
+	} else if i == pv.height && pv.right {
+		pv.sum = nodeSumWith(pv.hasher, pv.sum, h)
+	} else {
+		pv.sum = nodeSumWith(pv.hasher, h, pv.sum)
+	}
+	pv.hashesWritten++
+	return nil
+}
+
+// Verify returns true if the segment and exactly the expected number of proof
+// hashes have been written, and they produce the Merkle root.
+func (pv *ProofVerifier) Verify() bool {
+	return pv.verifyErr() == nil
+}
+
+// verifyErr is the same as Verify, but returns an error describing why
+// verification failed.
+func (pv *ProofVerifier) verifyErr() error {
+	if pv.err != nil {
+		return pv.err
+	} else if !pv.segmentWritten || pv.hashesWritten != pv.numHashes {
+		return ErrProofWrongLength
+	} else if !rootsEqual(pv.sum, pv.root) {
+		return ErrRootMismatch
+	}
+	return nil
+}
+
+// ComputeRootFromProof returns the Merkle root that a storage proof for the
+// segment at 'index' of a tree with 'numLeaves' leaves produces, so that it can
+// be compared with the expected root when diagnosing a failed proof. An error
+// is returned if the proof has the wrong number of hashes.
+func ComputeRootFromProof(base []byte, hashSet []Hash, numLeaves, index uint64) (Hash, error) {
+	pv := NewProofVerifier(numLeaves, index, Hash{})
+	if err := pv.WriteSegment(base); err != nil {
+		return Hash{}, err
+	}
+	for _, h := range hashSet {
+		if err := pv.WriteProofHash(h); err != nil {
+			return Hash{}, err
+		}
+	}
+	if pv.hashesWritten != pv.numHashes {
+		return Hash{}, ErrProofWrongLength
+	}
+	return pv.sum, nil
+}
+
+// VerifySegmentBuf is the same as VerifySegment, but does not allocate. Leaves
+// and nodes are concatenated in 'scratch' before they are hashed, so a single
+// buffer can be reused across many verifications. 'scratch' must be at least
+// VerifyScratchSize bytes, or VerifySegmentBuf panics. A base segment that
+// does not fit in 'scratch' is hashed as by VerifySegment.
+func VerifySegmentBuf(scratch, base []byte, hashSet []Hash, numLeaves, index uint64, root Hash) bool {
+	if len(scratch) < VerifyScratchSize {
+		panic("scratch buffer is smaller than VerifyScratchSize")
+	} else if index >= numLeaves {
+		return false
+	}
+	height, right, left := proofShape(numLeaves, index)
+	numHashes := int(height) + left
+	if right {
+		numHashes++
+	}
+	if len(hashSet) != numHashes {
+		return false
+	}
+
+	var sum Hash
+	if 1+len(base) <= len(scratch) {
+		scratch[0] = LeafHashPrefix
+		n := copy(scratch[1:], base)
+		sum = blake2b.Sum256(scratch[:1+n])
+	} else {
+		sum = leafSum(base)
+	}
+	// The hashes are combined in the same order as in WriteProofHash.
+	for i, h := range hashSet {
+		if i := uint64(i); (i < height && (index>>i)&1 == 0) || (i == height && right) {
+			sum = scratchNodeSum(scratch, sum, h)
+		} else {
+			sum = scratchNodeSum(scratch, h, sum)
+		}
+	}
+	return rootsEqual(sum, root)
+}
+
+// scratchNodeSum is the same as nodeSum, but concatenates the children in
+// 'scratch', which must be at least VerifyScratchSize bytes.
+func scratchNodeSum(scratch []byte, left, right Hash) Hash {
+	scratch[0] = NodeHashPrefix
+	copy(scratch[1:], left[:])
+	copy(scratch[1+HashSize:], right[:])
+	return blake2b.Sum256(scratch[:1+2*HashSize])
+}
+
+// VerifyTwoLevel verifies a segment of a file committed to in two levels: the
+// segment at 'sectorIndex' of a sector of 'segsPerSector' segments, proven by
+// 'sectorProof', and that sector's root at 'sectorIndexInFile' of the
+// 'numSectors' sector roots whose MerkleRootOfHashes is 'fileRoot', proven by
+// 'fileProof', as built by BuildHashProof. The sector root itself is never
+// needed, because it is recomputed from the segment.
+func VerifyTwoLevel(segment []byte, sectorProof []Hash, sectorIndex, segsPerSector uint64, fileProof []Hash, sectorIndexInFile, numSectors uint64, fileRoot Hash) bool {
+	sectorRoot, err := ComputeRootFromProof(segment, sectorProof, segsPerSector, sectorIndex)
+	if err != nil {
+		return false
+	}
+	return VerifySegment(sectorRoot[:], fileProof, numSectors, sectorIndexInFile, fileRoot)
+}
+
+// rootsEqual compares two Merkle roots in constant time, so that the time
+// taken to reject a proof does not reveal how much of the root it matched.
+func rootsEqual(a, b Hash) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// VerifyData reports whether 'data' has the Merkle root 'root'. No proof is
+// needed, because the whole tree is rebuilt from the data.
+func VerifyData(data []byte, root Hash) bool {
+	return rootsEqual(MerkleRoot(data), root)
+}
+
+// VerifyFromReaders verifies a storage proof whose base segment is read from
+// 'dataSeg' and whose hashes are read from 'proofHashes', each as HashSize
+// consecutive bytes. An error is returned if either reader holds the wrong
+// amount of data; false is returned if the proof is well formed but does not
+// produce 'root'.
+func VerifyFromReaders(dataSeg io.Reader, proofHashes io.Reader, numLeaves, index uint64, root Hash) (bool, error) {
+	if index >= numLeaves {
+		return false, ErrIndexOutOfRange
+	}
+	base, err := ioutil.ReadAll(io.LimitReader(dataSeg, SegmentSize+1))
+	if err != nil {
+		return false, err
+	} else if len(base) > SegmentSize {
+		return false, ErrSegmentTooLarge
+	}
+	pv := NewProofVerifier(numLeaves, index, root)
+	if err := pv.WriteSegment(base); err != nil {
+		return false, err
+	}
+	var h Hash
+	for i := 0; i < ProofSize(numLeaves, index); i++ {
+		if _, err := io.ReadFull(proofHashes, h[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, ErrProofWrongLength
+		} else if err != nil {
+			return false, err
+		}
+		if err := pv.WriteProofHash(h); err != nil {
+			return false, err
+		}
+	}
+	if n, err := proofHashes.Read(h[:1]); n != 0 {
+		return false, ErrProofWrongLength
+	} else if err != nil && err != io.EOF {
+		return false, err
+	}
+	return pv.Verify(), nil
+}
+
+// VerifyReaderSegment verifies a storage proof whose base segment is the next
+// 'segmentLen' bytes of 'r'. Exactly 'segmentLen' bytes are read, so the rest
+// of 'r' is left for the caller, even if the proof does not verify. An error
+// is returned if 'r' ends before the segment does, or if 'segmentLen' is
+// larger than SegmentSize.
+func VerifyReaderSegment(r io.Reader, segmentLen int, hashSet []Hash, numLeaves, index uint64, root Hash) (bool, error) {
+	if segmentLen > SegmentSize {
+		return false, ErrSegmentTooLarge
+	} else if segmentLen < 0 {
+		return false, errors.New("segment length is negative")
+	}
+	base := make([]byte, segmentLen)
+	if _, err := io.ReadFull(r, base); err == io.EOF {
+		return false, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return false, err
+	}
+	return VerifySegment(base, hashSet, numLeaves, index, root), nil
+}
+
+// VerifyBatch verifies each of 'proofs' with VerifySegment, spreading the work
+// across one goroutine per CPU. The result for each proof is returned in the
+// same order as the input.
+func VerifyBatch(proofs []SegmentProof) []bool {
+	results := make([]bool, len(proofs))
+	workers := runtime.NumCPU()
+	if workers > len(proofs) {
+		workers = len(proofs)
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range indices {
+				p := proofs[j]
+				results[j] = VerifySegment(p.Base, p.HashSet, p.NumLeaves, p.Index, p.Root)
+			}
+		}()
+	}
+	for i := range proofs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+// SameLeaf verifies two storage proofs for the segment at 'index' of a file
+// with 'numLeaves' leaves, each against its own root, and reports whether the
+// proven segments are identical. It is used to check that two hosts storing
+// the same file agree on a segment, without trusting either root. If either
+// proof is invalid, the reason is returned as an error.
+func SameLeaf(base1 []byte, proof1 []Hash, numLeaves, index uint64, root1 Hash, base2 []byte, proof2 []Hash, root2 Hash) (bool, error) {
+	if err := VerifySegmentErr(base1, proof1, numLeaves, index, root1); err != nil {
+		return false, err
+	} else if err := VerifySegmentErr(base2, proof2, numLeaves, index, root2); err != nil {
+		return false, err
+	}
+	return bytes.Equal(base1, base2), nil
+}
+
+// VerifyContractSegment is the same as VerifySegment, but takes the Merkle
+// root and number of leaves from 'fc'.
+func VerifyContractSegment(fc FileContractLike, base []byte, hashSet []Hash, index uint64) bool {
+	return VerifySegment(base, hashSet, CalculateLeaves(fc.FileSize()), index, fc.MerkleRoot())
+}
@@ -0,0 +1,345 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestProofVerifier checks that proofs can be verified one hash at a time.
+func TestProofVerifier(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*21 + 3)
+	root := MerkleRoot(data)
+	for i := uint64(0); i < 22; i++ {
+		base, hashSet := MerkleProof(data, i)
+		pv := NewProofVerifier(22, i, root)
+		if err := pv.WriteSegment(base); err != nil {
+			t.Fatal(err)
+		}
+		for j, h := range hashSet {
+			if pv.Verify() {
+				t.Fatal("proof verified after only", j, "hashes")
+			}
+			if err := pv.WriteProofHash(h); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !pv.Verify() {
+			t.Error("proof", i, "did not verify")
+		}
+
+		// Writing an extra hash should fail.
+		if err := pv.WriteProofHash(Hash{}); err != ErrProofWrongLength {
+			t.Error("expected ErrProofWrongLength, got", err)
+		} else if pv.Verify() {
+			t.Error("proof verified after an extra hash was written")
+		}
+	}
+
+	// Proof hashes cannot be written before the segment.
+	pv := NewProofVerifier(22, 0, root)
+	if err := pv.WriteProofHash(Hash{}); err != errProofOutOfOrder {
+		t.Error("expected errProofOutOfOrder, got", err)
+	}
+
+	// An index that is out of range can never verify.
+	pv = NewProofVerifier(22, 22, root)
+	if err := pv.WriteSegment(nil); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+}
+
+// TestVerifyBatch checks that VerifyBatch returns the result of each proof in
+// order.
+func TestVerifyBatch(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*21 + 3)
+	root := MerkleRoot(data)
+	var proofs []SegmentProof
+	for i := uint64(0); i < 22; i++ {
+		base, hashSet := MerkleProof(data, i)
+		p := SegmentProof{
+			Base:      base,
+			HashSet:   hashSet,
+			NumLeaves: 22,
+			Index:     i,
+			Root:      root,
+		}
+		// Corrupt every third proof.
+		if i%3 == 0 {
+			p.Root[0]++
+		}
+		proofs = append(proofs, p)
+	}
+	results := VerifyBatch(proofs)
+	if len(results) != len(proofs) {
+		t.Fatal("wrong number of results:", len(results))
+	}
+	for i, ok := range results {
+		if ok != (i%3 != 0) {
+			t.Error("wrong result for proof", i)
+		}
+	}
+	if len(VerifyBatch(nil)) != 0 {
+		t.Error("expected no results for an empty batch")
+	}
+}
+
+// TestVerifyFromReaders checks that a proof can be verified from separate
+// readers for the segment and the hashes.
+func TestVerifyFromReaders(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*12 + 40)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 9)
+	var proof bytes.Buffer
+	for _, h := range hashSet {
+		proof.Write(h[:])
+	}
+	encoded := proof.Bytes()
+
+	ok, err := VerifyFromReaders(bytes.NewReader(base), bytes.NewReader(encoded), 13, 9, root)
+	if err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("proof did not verify")
+	}
+	ok, err = VerifyFromReaders(bytes.NewReader(base), bytes.NewReader(encoded), 13, 9, HashBytes(data))
+	if err != nil || ok {
+		t.Error("proof verified against the wrong root", err)
+	}
+
+	// Readers holding the wrong amount of data should produce errors.
+	if _, err := VerifyFromReaders(bytes.NewReader(base), bytes.NewReader(encoded[1:]), 13, 9, root); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := VerifyFromReaders(bytes.NewReader(base), bytes.NewReader(append(encoded, 0)), 13, 9, root); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := VerifyFromReaders(bytes.NewReader(data), bytes.NewReader(encoded), 13, 9, root); err != ErrSegmentTooLarge {
+		t.Error("expected ErrSegmentTooLarge, got", err)
+	}
+	if _, err := VerifyFromReaders(bytes.NewReader(base), bytes.NewReader(encoded), 13, 13, root); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+}
+
+// TestRootsEqual checks the constant-time root comparison used by the
+// verifiers.
+func TestRootsEqual(t *testing.T) {
+	a := HashBytes([]byte("a"))
+	if !rootsEqual(a, a) {
+		t.Error("equal roots compared unequal")
+	}
+	for i := range a {
+		b := a
+		b[i]++
+		if rootsEqual(a, b) {
+			t.Error("roots differing at byte", i, "compared equal")
+		}
+	}
+}
+
+// TestComputeRootFromProof checks that the root recomputed from a proof is
+// reported, even when it is not the expected root.
+func TestComputeRootFromProof(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*10 + 1)
+	base, hashSet := MerkleProof(data, 6)
+	root, err := ComputeRootFromProof(base, hashSet, 11, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if root != MerkleRoot(data) {
+		t.Fatal("wrong root computed from proof")
+	}
+
+	// A corrupt segment should produce the root of the corrupt data.
+	data[6*SegmentSize]++
+	base[0]++
+	root, err = ComputeRootFromProof(base, hashSet, 11, 6)
+	if err != nil {
+		t.Fatal(err)
+	} else if root != MerkleRoot(data) {
+		t.Fatal("wrong root computed from a corrupt proof")
+	}
+
+	if _, err := ComputeRootFromProof(base, hashSet[1:], 11, 6); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := ComputeRootFromProof(base, append(hashSet, Hash{}), 11, 6); err != ErrProofWrongLength {
+		t.Error("expected ErrProofWrongLength, got", err)
+	}
+	if _, err := ComputeRootFromProof(base, hashSet, 11, 11); err != ErrIndexOutOfRange {
+		t.Error("expected ErrIndexOutOfRange, got", err)
+	}
+}
+
+// TestSameLeaf checks that SameLeaf only reports agreement when both proofs
+// are valid and prove the same segment.
+func TestSameLeaf(t *testing.T) {
+	data1 := fastrand.Bytes(SegmentSize * 8)
+	data2 := append([]byte(nil), data1...)
+	data2[0]++
+	root1, root2 := MerkleRoot(data1), MerkleRoot(data2)
+
+	// The files differ only in segment 0.
+	base1, proof1 := MerkleProof(data1, 5)
+	base2, proof2 := MerkleProof(data2, 5)
+	if same, err := SameLeaf(base1, proof1, 8, 5, root1, base2, proof2, root2); err != nil || !same {
+		t.Fatal("hosts should agree on segment 5:", err)
+	}
+	base1, proof1 = MerkleProof(data1, 0)
+	base2, proof2 = MerkleProof(data2, 0)
+	if same, err := SameLeaf(base1, proof1, 8, 0, root1, base2, proof2, root2); err != nil || same {
+		t.Fatal("hosts should disagree on segment 0:", err)
+	}
+
+	// An invalid proof should be reported.
+	if _, err := SameLeaf(base1, proof1, 8, 0, root1, base2, proof2, root1); err != ErrRootMismatch {
+		t.Error("expected ErrRootMismatch, got", err)
+	}
+}
+
+// TestVerifySegmentBuf checks that VerifySegmentBuf agrees with VerifySegment
+// and does not allocate.
+func TestVerifySegmentBuf(t *testing.T) {
+	scratch := make([]byte, VerifyScratchSize)
+	for _, size := range []int{1, SegmentSize * 4, SegmentSize*13 + 9} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		numLeaves := CalculateLeaves(uint64(size))
+		for index := uint64(0); index < numLeaves; index++ {
+			base, hashSet := MerkleProof(data, index)
+			if !VerifySegmentBuf(scratch, base, hashSet, numLeaves, index, root) {
+				t.Fatalf("proof for index %v of %v bytes did not verify", index, size)
+			}
+			base[0]++
+			if VerifySegmentBuf(scratch, base, hashSet, numLeaves, index, root) {
+				t.Fatalf("corrupt proof for index %v of %v bytes verified", index, size)
+			}
+			base[0]--
+			if numLeaves > 1 && VerifySegmentBuf(scratch, base, hashSet[1:], numLeaves, index, root) {
+				t.Fatalf("short proof for index %v of %v bytes verified", index, size)
+			}
+		}
+	}
+
+	data := fastrand.Bytes(SegmentSize * 100)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 37)
+	allocs := testing.AllocsPerRun(100, func() {
+		VerifySegmentBuf(scratch, base, hashSet, 100, 37, root)
+	})
+	if allocs != 0 {
+		t.Error("VerifySegmentBuf allocated", allocs, "times")
+	}
+}
+
+// testContract implements FileContractLike.
+type testContract struct {
+	root Hash
+	size uint64
+}
+
+func (tc testContract) MerkleRoot() Hash { return tc.root }
+func (tc testContract) FileSize() uint64 { return tc.size }
+
+// TestVerifyContractSegment checks that VerifyContractSegment takes the root
+// and number of leaves from the contract.
+func TestVerifyContractSegment(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*6 + 30)
+	fc := testContract{root: MerkleRoot(data), size: uint64(len(data))}
+	for index := uint64(0); index < 7; index++ {
+		base, hashSet := MerkleProof(data, index)
+		if !VerifyContractSegment(fc, base, hashSet, index) {
+			t.Fatal("proof did not verify against the contract for index", index)
+		}
+	}
+
+	// A contract for a file of a different size should reject the proofs.
+	base, hashSet := MerkleProof(data, 6)
+	fc.size = SegmentSize * 9
+	if VerifyContractSegment(fc, base, hashSet, 6) {
+		t.Error("proof verified against a contract with the wrong size")
+	}
+}
+
+// TestVerifyData checks that VerifyData only accepts data with the given root.
+func TestVerifyData(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize*5 + 3} {
+		data := fastrand.Bytes(size)
+		root := MerkleRoot(data)
+		if !VerifyData(data, root) {
+			t.Fatal("data did not match its own root for size", size)
+		}
+		if VerifyData(append(data, 0), root) {
+			t.Fatal("extended data matched the root for size", size)
+		}
+	}
+}
+
+// TestVerifyTwoLevel checks that a segment can be verified against a file root
+// built from sector roots, including a segment of a short final sector.
+func TestVerifyTwoLevel(t *testing.T) {
+	const segsPerSector = 8
+	data := fastrand.Bytes(SegmentSize*segsPerSector*3 + SegmentSize*2 + 9)
+	roots, err := SectorRoots(bytes.NewReader(data), SegmentSize*segsPerSector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileRoot := MerkleRootOfHashes(roots)
+	numSectors := uint64(len(roots))
+
+	for _, test := range []struct {
+		sector, segment, numSegs uint64
+	}{
+		{0, 0, segsPerSector},
+		{2, 5, segsPerSector},
+		{3, 2, 3},
+	} {
+		sectorData := data[test.sector*SegmentSize*segsPerSector:]
+		if uint64(len(sectorData)) > SegmentSize*segsPerSector {
+			sectorData = sectorData[:SegmentSize*segsPerSector]
+		}
+		segment, sectorProof := MerkleProof(sectorData, test.segment)
+		_, fileProof := BuildHashProof(roots, test.sector)
+		if !VerifyTwoLevel(segment, sectorProof, test.segment, test.numSegs, fileProof, test.sector, numSectors, fileRoot) {
+			t.Fatalf("segment %v of sector %v did not verify", test.segment, test.sector)
+		}
+		if VerifyTwoLevel(segment, sectorProof, test.segment, test.numSegs, fileProof, test.sector^1, numSectors, fileRoot) {
+			t.Fatalf("segment %v of sector %v verified at the wrong sector", test.segment, test.sector)
+		}
+	}
+}
+
+// TestVerifyReaderSegment checks that VerifyReaderSegment consumes exactly the
+// base segment from a stream.
+func TestVerifyReaderSegment(t *testing.T) {
+	data := fastrand.Bytes(SegmentSize*7 + 21)
+	root := MerkleRoot(data)
+	base, hashSet := MerkleProof(data, 7)
+	trailer := []byte("next message")
+	r := bytes.NewReader(append(append([]byte(nil), base...), trailer...))
+	if ok, err := VerifyReaderSegment(r, len(base), hashSet, 8, 7, root); err != nil || !ok {
+		t.Fatal("segment read from the stream did not verify:", err)
+	}
+	if rest, _ := ioutil.ReadAll(r); !bytes.Equal(rest, trailer) {
+		t.Fatal("stream was not left after the segment:", rest)
+	}
+
+	// A failed proof should still consume only the segment.
+	r = bytes.NewReader(append(append([]byte(nil), base...), trailer...))
+	if ok, err := VerifyReaderSegment(r, len(base), hashSet, 8, 6, root); err != nil || ok {
+		t.Fatal("segment verified at the wrong index:", err)
+	}
+	if r.Len() != len(trailer) {
+		t.Fatal("failed verification consumed the wrong amount of data")
+	}
+
+	if _, err := VerifyReaderSegment(bytes.NewReader(base[:5]), len(base), hashSet, 8, 7, root); err != io.ErrUnexpectedEOF {
+		t.Error("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if _, err := VerifyReaderSegment(r, SegmentSize+1, hashSet, 8, 7, root); err != ErrSegmentTooLarge {
+		t.Error("expected ErrSegmentTooLarge, got", err)
+	}
+}
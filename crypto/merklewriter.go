@@ -0,0 +1,81 @@
+package crypto
+
+// merklewriter.go contains writers that compute Merkle roots. RootWriter
+// computes the root of the data written to it, so that a root can be computed
+// while the data is copied elsewhere, and ObjectTreeWriter computes the root of
+// a series of objects.
+
+// A RootWriter is an io.Writer that computes the Merkle root of the data
+// written to it. It can be used with io.MultiWriter or io.TeeReader to hash
+// data without a second pass.
+type RootWriter struct {
+	tree    *MerkleTree
+	segment [SegmentSize]byte
+	pending int
+}
+
+// NewRootWriter returns a RootWriter with no data written to it.
+func NewRootWriter() *RootWriter {
+	return &RootWriter{
+		tree: NewTree(),
+	}
+}
+
+// Write implements io.Writer. It never returns an error.
+func (rw *RootWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		copied := copy(rw.segment[rw.pending:], p)
+		rw.pending += copied
+		p = p[copied:]
+		if rw.pending == SegmentSize {
+			rw.tree.Push(rw.segment[:])
+			rw.pending = 0
+		}
+	}
+	return n, nil
+}
+
+// Root returns the Merkle root of the data written so far. A final partial
+// segment is hashed as-is, exactly as ReaderMerkleRoot hashes it. More data
+// may be written after calling Root.
+func (rw *RootWriter) Root() Hash {
+	if rw.pending == 0 {
+		return rw.tree.Root()
+	}
+	s := append(subtreeStack(nil), rw.tree.stack...)
+	s.push(subtree{index: rw.tree.numLeaves, sum: leafSum(rw.segment[:rw.pending])})
+	return s.root()
+}
+
+// An ObjectTreeWriter builds a Merkle tree with one leaf per object, as
+// MerkleTree.PushObject does. Each call to Write is treated as one encoded
+// object, so writing encoding.Marshal(obj) is the same as calling
+// PushObject(obj).
+type ObjectTreeWriter struct {
+	tree *MerkleTree
+}
+
+// NewObjectTreeWriter returns an ObjectTreeWriter with no objects pushed.
+func NewObjectTreeWriter() *ObjectTreeWriter {
+	return &ObjectTreeWriter{
+		tree: NewTree(),
+	}
+}
+
+// PushObject encodes 'obj' and adds it to the tree as a leaf.
+func (otw *ObjectTreeWriter) PushObject(obj interface{}) {
+	otw.tree.PushObject(obj)
+}
+
+// Write implements io.Writer, adding 'p' to the tree as a single leaf. It never
+// returns an error.
+func (otw *ObjectTreeWriter) Write(p []byte) (int, error) {
+	otw.tree.Push(p)
+	return len(p), nil
+}
+
+// Root returns the Merkle root of the objects pushed so far.
+func (otw *ObjectTreeWriter) Root() Hash {
+	return otw.tree.Root()
+}
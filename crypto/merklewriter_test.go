@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/fastrand"
+)
+
+// TestRootWriter checks that RootWriter matches MerkleRoot regardless of how
+// the data is split between writes.
+func TestRootWriter(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize, SegmentSize*9 + 30, SegmentSize * 32} {
+		data := fastrand.Bytes(size)
+		rw := NewRootWriter()
+		for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+			if _, err := rw.Write(buf.Next(fastrand.Intn(SegmentSize*3) + 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rw.Root() != MerkleRoot(data) {
+			t.Fatal("RootWriter does not match MerkleRoot for size", size)
+		}
+	}
+
+	// The root can be checked between writes, and the writer can be used
+	// alongside another destination.
+	data := fastrand.Bytes(SegmentSize*4 + 10)
+	var dst bytes.Buffer
+	rw := NewRootWriter()
+	w := io.MultiWriter(&dst, rw)
+	w.Write(data[:SegmentSize+5])
+	if rw.Root() != MerkleRoot(data[:SegmentSize+5]) {
+		t.Fatal("wrong root after partial write")
+	}
+	w.Write(data[SegmentSize+5:])
+	if rw.Root() != MerkleRoot(data) || !bytes.Equal(dst.Bytes(), data) {
+		t.Fatal("wrong root or data after the final write")
+	}
+}
+
+// TestObjectTreeWriter checks that ObjectTreeWriter matches a MerkleTree built
+// with PushObject, whether objects are pushed or written.
+func TestObjectTreeWriter(t *testing.T) {
+	tree := NewTree()
+	otw := NewObjectTreeWriter()
+	for i := 0; i < 11; i++ {
+		tree.PushObject(i)
+		if i%2 == 0 {
+			otw.PushObject(i)
+		} else if _, err := otw.Write(encoding.Marshal(i)); err != nil {
+			t.Fatal(err)
+		}
+		if otw.Root() != tree.Root() {
+			t.Fatal("ObjectTreeWriter does not match PushObject after", i+1, "objects")
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package crypto
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first 'size' bytes of 'f' into memory as read-only.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile unmaps memory that was mapped by mmapFile.
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
+
+// releasePages informs the operating system that the mapped memory 'b' will
+// not be accessed again, allowing its pages to be reclaimed.
+func releasePages(b []byte) {
+	// The advice is only an optimization, so any error is ignored.
+	syscall.Madvise(b, syscall.MADV_DONTNEED)
+}
@@ -0,0 +1,21 @@
+// +build !linux
+
+package crypto
+
+import (
+	"os"
+)
+
+// mmapFile is not supported on this platform, causing callers to fall back to
+// streaming reads.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmapFile is not supported on this platform.
+func munmapFile(b []byte) error {
+	return errMmapUnsupported
+}
+
+// releasePages is not supported on this platform.
+func releasePages(b []byte) {}